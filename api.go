@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// apiError is the body of every non-2xx API response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiAddFeedResponse is returned by POST /api/feeds. The feed history is
+// published by the job.
+type apiAddFeedResponse struct {
+	Feed *feedStruct `json:"feed"`
+	Job  *jobStruct  `json:"job,omitempty"`
+}
+
+// apiCandidates is returned instead of a feed if a website offers several
+// feeds. The client has to add one of them by its url.
+type apiCandidates struct {
+	Error      string          `json:"error"`
+	Candidates []feedCandidate `json:"candidates"`
+}
+
+// apiAddFeedRequest is the body of POST /api/feeds.
+type apiAddFeedRequest struct {
+	Url      string    `json:"url"`
+	Relays   *[]string `json:"relays"`
+	Tags     *[]string `json:"tags"`
+	Mode     *string   `json:"mode"`
+	Dedupe   *string   `json:"dedupe"`
+	Interval *string   `json:"interval"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("[ERROR] Can't write API response:", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+// apiFeedFromPath looks up the feed addressed by the {npub} path value. Hex
+// public keys are accepted as well.
+func (a *Atomstr) apiFeedFromPath(w http.ResponseWriter, r *http.Request) (*feedStruct, bool) {
+	pub := r.PathValue("npub")
+	if prefix, value, err := nip19.Decode(pub); err == nil {
+		if prefix != "npub" {
+			writeJSONError(w, http.StatusBadRequest, "expected an npub, got "+prefix)
+			return nil, false
+		}
+		pub = value.(string)
+	} else if !nostr.IsValid32ByteHex(pub) {
+		writeJSONError(w, http.StatusBadRequest, "invalid npub")
+		return nil, false
+	}
+
+	feedItem := a.dbGetFeedByPub(pub)
+	if feedItem.Url == "" {
+		writeJSONError(w, http.StatusNotFound, "feed not found")
+		return nil, false
+	}
+	return feedItem, true
+}
+
+func (a *Atomstr) apiListFeeds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.dbGetAllFeeds())
+}
+
+func (a *Atomstr) apiGetFeed(w http.ResponseWriter, r *http.Request) {
+	feedItem, ok := a.apiFeedFromPath(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, feedItem)
+}
+
+func (a *Atomstr) apiAddFeed(w http.ResponseWriter, r *http.Request) {
+	var req apiAddFeedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Url == "" {
+		writeJSONError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+
+	settings, err := parseFeedSettings(nil, nil, req.Mode, req.Dedupe, req.Interval)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Relays != nil {
+		relays := []string{}
+		for _, relay := range *req.Relays {
+			relays = append(relays, parseRelayList(relay)...)
+		}
+		settings.Relays = &relays
+	}
+	if req.Tags != nil {
+		tags := []string{}
+		for _, tag := range *req.Tags {
+			tags = append(tags, parseTagList(tag)...)
+		}
+		settings.Tags = &tags
+	}
+
+	feedItem, job, err := a.addSourceAsync(appContext(r), req.Url, settings)
+	var candidates *feedCandidatesError
+	if errors.As(err, &candidates) {
+		writeJSON(w, http.StatusMultipleChoices, apiCandidates{Error: err.Error(), Candidates: candidates.Candidates})
+		return
+	} else if errors.Is(err, errFeedExists) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "no valid feed found: "+err.Error())
+		return
+	}
+	feedItem.Npub, _ = nip19.EncodePublicKey(feedItem.Pub)
+	if job == nil {
+		writeJSON(w, http.StatusCreated, apiAddFeedResponse{Feed: feedItem})
+		return
+	}
+	w.Header().Set("Location", "/api/jobs/"+job.Id)
+	writeJSON(w, http.StatusAccepted, apiAddFeedResponse{Feed: feedItem, Job: job})
+}
+
+// apiRunsResponse is returned by GET /api/runs.
+type apiRunsResponse struct {
+	InProgress bool        `json:"in_progress"`
+	Running    []runStruct `json:"running"`
+	Recent     []runStruct `json:"recent"`
+}
+
+func (a *Atomstr) apiListRuns(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+	recent, err := a.dbGetRuns(limit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "can't read runs")
+		return
+	}
+	running := a.sched.inProgress()
+	writeJSON(w, http.StatusOK, apiRunsResponse{InProgress: len(running) > 0, Running: running, Recent: recent})
+}
+
+func (a *Atomstr) apiGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.dbGetJob(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (a *Atomstr) apiDeleteFeed(w http.ResponseWriter, r *http.Request) {
+	feedItem, ok := a.apiFeedFromPath(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("purge") == "true" {
+		// publishing the deletions takes a while, don't let the client cut it short
+		job, err := a.purgeSourceAsync(feedItem.Url)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "can't queue purge: "+err.Error())
+			return
+		}
+		w.Header().Set("Location", "/api/jobs/"+job.Id)
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+	if err := a.deleteSource(r.Context(), feedItem.Url, false); errors.Is(err, errFeedNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "can't remove feed: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Atomstr) apiPauseFeed(w http.ResponseWriter, r *http.Request) {
+	feedItem, ok := a.apiFeedFromPath(w, r)
+	if !ok {
+		return
+	}
+	feedItem, err := a.pauseFeed(feedItem.Url)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, feedItem)
+}
+
+func (a *Atomstr) apiResumeFeed(w http.ResponseWriter, r *http.Request) {
+	feedItem, ok := a.apiFeedFromPath(w, r)
+	if !ok {
+		return
+	}
+	feedItem, err := a.resumeFeed(feedItem.Url)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, feedItem)
+}
+
+func (a *Atomstr) apiListPosts(w http.ResponseWriter, r *http.Request) {
+	feedItem, ok := a.apiFeedFromPath(w, r)
+	if !ok {
+		return
+	}
+	limit, offset := 100, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must not be negative")
+			return
+		}
+		offset = n
+	}
+
+	posts, err := a.dbGetPublishedPosts(feedItem.Url, limit, offset)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "can't read published posts")
+		return
+	}
+	writeJSON(w, http.StatusOK, posts)
+}
+
+// dbGetPublishedPosts returns the posts recorded for a feed, newest first.
+// Only link, GUID and publishing time are stored, the other fields stay empty.
+func (a *Atomstr) dbGetPublishedPosts(feedUrl string, limit, offset int) ([]feedPostStruct, error) {
+	sqlStatement := `SELECT url, guid, published_at, nostr_event_id FROM published_posts WHERE feed_url=? AND deleted_at=0 ORDER BY published_at DESC, id DESC LIMIT ? OFFSET ?;`
+	rows, err := a.db.Query(sqlStatement, feedUrl, limit, offset)
+	if err != nil {
+		log.Println("[ERROR] Failed to read published posts:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []feedPostStruct{}
+	for rows.Next() {
+		post := feedPostStruct{}
+		if err := rows.Scan(&post.Link, &post.GUID, &post.PublishedUnix, &post.NostrEventId); err != nil {
+			log.Println("[ERROR] Scanning published posts failed:", err)
+			return nil, err
+		}
+		post.Published = time.Unix(post.PublishedUnix, 0).UTC().Format(time.RFC3339)
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+func (a *Atomstr) apiRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/feeds", a.apiListFeeds)
+	mux.HandleFunc("POST /api/feeds", a.requireAdmin(a.apiAddFeed))
+	mux.HandleFunc("GET /api/feeds/{npub}", a.apiGetFeed)
+	mux.HandleFunc("DELETE /api/feeds/{npub}", a.requireAdmin(a.apiDeleteFeed))
+	mux.HandleFunc("GET /api/feeds/{npub}/posts", a.apiListPosts)
+	mux.HandleFunc("POST /api/feeds/{npub}/pause", a.requireAdmin(a.apiPauseFeed))
+	mux.HandleFunc("POST /api/feeds/{npub}/resume", a.requireAdmin(a.apiResumeFeed))
+	mux.HandleFunc("GET /api/jobs/{id}", a.apiGetJob)
+	mux.HandleFunc("GET /api/runs", a.apiListRuns)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const articleSummaryLength = 280
+
+// nostrArticleEvent builds a NIP-23 long-form article from a feed post. The
+// HTML body is converted to Markdown and the item GUID is used as identifier,
+// so updates of the same item replace the earlier article.
+func nostrArticleEvent(feedItem feedStruct, feedPost *gofeed.Item) nostr.Event {
+	body := feedPost.Content
+	if body == "" {
+		body = feedPost.Description
+	}
+	content := htmlToMarkdown(body)
+	if feedPost.Link != "" {
+		content = content + "\n\n[Read the original](" + feedPost.Link + ")"
+	}
+
+	tags := nostr.Tags{
+		nostr.Tag{"d", articleIdentifier(feedPost)},
+		nostr.Tag{"title", feedPost.Title},
+	}
+	if summary := articleSummary(feedPost); summary != "" {
+		tags = append(tags, nostr.Tag{"summary", summary})
+	}
+	if image := articleImage(feedPost); image != "" {
+		tags = append(tags, nostr.Tag{"image", image})
+	}
+	tags = append(tags, nostr.Tag{"published_at", strconv.FormatInt(feedPost.PublishedParsed.Unix(), 10)})
+	for _, category := range feedPost.Categories {
+		tags = append(tags, nostr.Tag{"t", category})
+	}
+	tags = append(tags, nostr.Tag{"proxy", feedItem.Url + `#` + url.QueryEscape(feedPost.Link), "rss"})
+
+	// created_at is when this version was signed, the post date is in published_at
+	return nostr.Event{
+		PubKey:    feedItem.Pub,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindArticle,
+		Tags:      tags,
+		Content:   content,
+	}
+}
+
+// publishArticleTeaser posts a short kind 1 note pointing to a published
+// article and returns its event ID, or "" if it was not published.
+func (a *Atomstr) publishArticleTeaser(ctx context.Context, feedItem feedStruct, feedPost *gofeed.Item, article nostr.Event) string {
+	identifier := article.Tags.GetD()
+	if identifier == "" {
+		log.Println("[ERROR] Article without d tag, not posting teaser")
+		return ""
+	}
+	relays := feedItem.publishRelays()
+	naddr, err := nip19.EncodeEntity(feedItem.Pub, nostr.KindArticle, identifier, relays)
+	if err != nil {
+		log.Println("[ERROR] Can't encode naddr:", err)
+		return ""
+	}
+
+	content := feedPost.Title
+	if summary := articleSummary(feedPost); summary != "" {
+		content = content + "\n\n" + summary
+	}
+	content = content + "\n\nnostr:" + naddr
+	if feedPost.Link != "" {
+		content = content + "\n\n" + feedPost.Link
+	}
+
+	aTag := nostr.Tag{"a", strconv.Itoa(nostr.KindArticle) + ":" + feedItem.Pub + ":" + identifier}
+	if len(relays) > 0 {
+		aTag = append(aTag, relays[0])
+	}
+	tags := nostr.Tags{aTag}
+	for _, category := range feedPost.Categories {
+		tags = append(tags, nostr.Tag{"t", category})
+	}
+
+	ev := nostr.Event{
+		PubKey:    feedItem.Pub,
+		CreatedAt: nostr.Timestamp(feedPost.PublishedParsed.Unix()),
+		Kind:      nostr.KindTextNote,
+		Tags:      tags,
+		Content:   content,
+	}
+	ev.Sign(feedItem.Sec)
+
+	if noPub {
+		log.Println("[DEBUG] not publishing teaser", ev)
+		return ""
+	}
+	publishedCount, errCount := a.nostrPublishDurable(ctx, ev, feedItem.Url, relays)
+	log.Printf("[DEBUG] Published teaser to %d / %d relays\n", publishedCount, errCount+publishedCount)
+	return ev.ID
+}
+
+// articleIdentifier returns the d tag of an article: the item GUID, the link
+// or a hash of the title as last resort.
+func articleIdentifier(feedPost *gofeed.Item) string {
+	if feedPost.GUID != "" {
+		return feedPost.GUID
+	}
+	if feedPost.Link != "" {
+		return feedPost.Link
+	}
+	sum := sha256.Sum256([]byte(feedPost.Title))
+	return hex.EncodeToString(sum[:])
+}
+
+// articleSummary returns the item description as plain text, shortened.
+func articleSummary(feedPost *gofeed.Item) string {
+	if feedPost.Content == "" {
+		// the description is the article body, don't repeat it
+		return ""
+	}
+	summary := html.UnescapeString(bluemonday.StrictPolicy().Sanitize(feedPost.Description))
+	summary = strings.Join(strings.Fields(summary), " ")
+	if runes := []rune(summary); len(runes) > articleSummaryLength {
+		summary = strings.TrimSpace(string(runes[:articleSummaryLength])) + "…"
+	}
+	return summary
+}
+
+// articleImage returns the item image or the first image enclosure.
+func articleImage(feedPost *gofeed.Item) string {
+	if feedPost.Image != nil && feedPost.Image.URL != "" {
+		return feedPost.Image.URL
+	}
+	for _, enclosure := range feedPost.Enclosures {
+		if strings.HasPrefix(enclosure.Type, "image/") {
+			return enclosure.URL
+		}
+	}
+	return ""
+}
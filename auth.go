@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// nip98Kind is the kind of NIP-98 HTTP auth events.
+const nip98Kind = 27235
+
+// nip98MaxSkew is how far the created_at of a NIP-98 event may be off.
+var nip98MaxSkew = 60 * time.Second
+
+// authEnabled reports whether any admin credential is configured.
+func authEnabled() bool {
+	return adminToken != "" || adminUser != "" || len(adminPubkeys) > 0
+}
+
+// checkAuthConfig rejects admin credentials that can't be used safely.
+func checkAuthConfig() error {
+	if adminUser != "" && adminPassword == "" {
+		return errors.New("ADMIN_USER is set without ADMIN_PASSWORD")
+	}
+	return nil
+}
+
+// parseAdminNpubs returns the hex public keys of a comma separated npub list.
+func parseAdminNpubs(npubs string) map[string]bool {
+	pubkeys := map[string]bool{}
+	for _, npub := range strings.Split(npubs, ",") {
+		npub = strings.TrimSpace(npub)
+		if npub == "" {
+			continue
+		}
+		if prefix, value, err := nip19.Decode(npub); err == nil && prefix == "npub" {
+			pubkeys[value.(string)] = true
+		} else if nostr.IsValid32ByteHex(npub) {
+			pubkeys[npub] = true
+		} else {
+			log.Println("[WARN] Ignoring invalid admin npub", npub)
+		}
+	}
+	return pubkeys
+}
+
+// requireAdmin protects a mutating handler. A request is let through if it
+// carries the static bearer token, valid basic auth credentials or a NIP-98
+// event signed by one of the admin npubs. Without any configured credentials
+// the handler is closed, unless ADMIN_AUTH_DISABLED is set. Changes sent by
+// a browser from another site are always rejected.
+func (a *Atomstr) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkSameOrigin(r); err != nil {
+			log.Println("[WARN] Rejected request to", r.URL.Path+":", err)
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeJSONError(w, http.StatusForbidden, err.Error())
+			} else {
+				http.Error(w, err.Error(), http.StatusForbidden)
+			}
+			return
+		}
+		if !authEnabled() && adminAuthDisabled {
+			next(w, r)
+			return
+		}
+		err := errors.New("no admin credentials configured")
+		if authEnabled() {
+			err = checkAdminAuth(r)
+		}
+		if err == nil {
+			next(w, r)
+			return
+		}
+		log.Println("[WARN] Unauthorized request to", r.URL.Path+":", err)
+		if adminUser != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="atomstr"`)
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		} else {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+	}
+}
+
+func checkAdminAuth(r *http.Request) error {
+	header := r.Header.Get("Authorization")
+	scheme, credentials, _ := strings.Cut(header, " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		if adminToken == "" {
+			return errors.New("bearer token auth not configured")
+		}
+		if subtle.ConstantTimeCompare([]byte(credentials), []byte(adminToken)) != 1 {
+			return errors.New("invalid bearer token")
+		}
+		return nil
+	case "basic":
+		if adminUser == "" {
+			return errors.New("basic auth not configured")
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return errors.New("malformed basic auth")
+		}
+		userOk := subtle.ConstantTimeCompare([]byte(user), []byte(adminUser)) == 1
+		passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(adminPassword)) == 1
+		if !userOk || !passwordOk {
+			return errors.New("invalid basic auth credentials")
+		}
+		return nil
+	case "nostr":
+		return checkNip98Auth(r, credentials)
+	case "":
+		return errors.New("missing Authorization header")
+	}
+	return errors.New("unsupported auth scheme " + scheme)
+}
+
+// checkNip98Auth validates a NIP-98 HTTP auth event for this request.
+func checkNip98Auth(r *http.Request, credentials string) error {
+	if len(adminPubkeys) == 0 {
+		return errors.New("NIP-98 auth not configured")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return errors.New("NIP-98 event is not base64")
+	}
+	var ev nostr.Event
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return errors.New("NIP-98 event is not valid JSON")
+	}
+	if ev.Kind != nip98Kind {
+		return errors.New("NIP-98 event has wrong kind")
+	}
+	if ok, err := ev.CheckSignature(); err != nil || !ok {
+		return errors.New("NIP-98 event has invalid signature")
+	}
+	if !adminPubkeys[ev.PubKey] {
+		return errors.New("NIP-98 event not signed by an admin")
+	}
+	skew := time.Since(ev.CreatedAt.Time())
+	if skew > nip98MaxSkew || skew < -nip98MaxSkew {
+		return errors.New("NIP-98 event is expired")
+	}
+
+	u := ev.Tags.GetFirst([]string{"u", ""})
+	if u == nil || strings.TrimSuffix((*u)[1], "/") != strings.TrimSuffix(requestURL(r), "/") {
+		return errors.New("NIP-98 event url does not match")
+	}
+	method := ev.Tags.GetFirst([]string{"method", ""})
+	if method == nil || !strings.EqualFold((*method)[1], r.Method) {
+		return errors.New("NIP-98 event method does not match")
+	}
+
+	if payload := ev.Tags.GetFirst([]string{"payload", ""}); payload != nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		if !strings.EqualFold((*payload)[1], hex.EncodeToString(sum[:])) {
+			return errors.New("NIP-98 payload hash does not match")
+		}
+	}
+	return nil
+}
+
+// checkSameOrigin rejects requests that change something and were sent by a
+// browser from another site. Browsers send basic auth credentials along on
+// their own, so any page could otherwise submit the admin forms. The Origin
+// header is checked, or the Referer if there is none. Clients sending
+// neither, like curl, are let through.
+func checkSameOrigin(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return nil
+	}
+	u, err := url.Parse(source)
+	if err != nil || !strings.EqualFold(u.Host, requestHost(r)) {
+		return errors.New("cross-site request from " + source)
+	}
+	return nil
+}
+
+// requestURL reconstructs the absolute URL the client requested. The headers
+// set by a reverse proxy are only honored with TRUST_PROXY_HEADERS, otherwise
+// any client could pick the URL a NIP-98 event is checked against.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); trustProxyHeaders && proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + requestHost(r) + r.URL.RequestURI()
+}
+
+// requestHost is the host the client requested, see requestURL.
+func requestHost(r *http.Request) string {
+	if fwdHost := r.Header.Get("X-Forwarded-Host"); trustProxyHeaders && fwdHost != "" {
+		return fwdHost
+	}
+	return r.Host
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCheckNip98Auth(t *testing.T) {
+	adminSec := nostr.GeneratePrivateKey()
+	adminPub, _ := nostr.GetPublicKey(adminSec)
+	otherSec := nostr.GeneratePrivateKey()
+
+	savedPubkeys := adminPubkeys
+	adminPubkeys = map[string]bool{adminPub: true}
+	t.Cleanup(func() { adminPubkeys = savedPubkeys })
+
+	const target = "http://example.com/api/feeds"
+	body := `{"url":"https://example.com/rss"}`
+	bodyHash := sha256.Sum256([]byte(body))
+
+	// event builds a NIP-98 event, modify can change it before signing
+	event := func(sec string, modify func(ev *nostr.Event)) string {
+		ev := nostr.Event{
+			Kind:      nip98Kind,
+			CreatedAt: nostr.Now(),
+			Tags:      nostr.Tags{{"u", target}, {"method", "POST"}},
+		}
+		if modify != nil {
+			modify(&ev)
+		}
+		ev.Sign(sec)
+		raw, _ := json.Marshal(ev)
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+
+	tests := []struct {
+		name        string
+		credentials string
+		method      string
+		wantErr     string
+	}{
+		{"valid", event(adminSec, nil), "POST", ""},
+		{"method case ignored", event(adminSec, func(ev *nostr.Event) { ev.Tags[1][1] = "post" }), "POST", ""},
+		{"trailing slash ignored", event(adminSec, func(ev *nostr.Event) { ev.Tags[0][1] = target + "/" }), "POST", ""},
+		{"matching payload", event(adminSec, func(ev *nostr.Event) {
+			ev.Tags = append(ev.Tags, nostr.Tag{"payload", hex.EncodeToString(bodyHash[:])})
+		}), "POST", ""},
+		{"not base64", "%%%", "POST", "not base64"},
+		{"not json", base64.StdEncoding.EncodeToString([]byte("nope")), "POST", "not valid JSON"},
+		{"wrong kind", event(adminSec, func(ev *nostr.Event) { ev.Kind = nostr.KindTextNote }), "POST", "wrong kind"},
+		{"not an admin", event(otherSec, nil), "POST", "not signed by an admin"},
+		{"expired", event(adminSec, func(ev *nostr.Event) {
+			ev.CreatedAt = nostr.Timestamp(time.Now().Add(-2 * nip98MaxSkew).Unix())
+		}), "POST", "expired"},
+		{"from the future", event(adminSec, func(ev *nostr.Event) {
+			ev.CreatedAt = nostr.Timestamp(time.Now().Add(2 * nip98MaxSkew).Unix())
+		}), "POST", "expired"},
+		{"other url", event(adminSec, func(ev *nostr.Event) { ev.Tags[0][1] = "http://example.com/api/jobs" }), "POST", "url does not match"},
+		{"missing url", event(adminSec, func(ev *nostr.Event) { ev.Tags = ev.Tags[1:] }), "POST", "url does not match"},
+		{"other method", event(adminSec, nil), "DELETE", "method does not match"},
+		{"other payload", event(adminSec, func(ev *nostr.Event) {
+			ev.Tags = append(ev.Tags, nostr.Tag{"payload", strings.Repeat("0", 64)})
+		}), "POST", "payload hash does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, target, strings.NewReader(body))
+			err := checkNip98Auth(r, tt.credentials)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkNip98Auth() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkNip98Auth() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckNip98AuthTamperedSignature(t *testing.T) {
+	sec := nostr.GeneratePrivateKey()
+	pub, _ := nostr.GetPublicKey(sec)
+	savedPubkeys := adminPubkeys
+	adminPubkeys = map[string]bool{pub: true}
+	t.Cleanup(func() { adminPubkeys = savedPubkeys })
+
+	ev := nostr.Event{Kind: nip98Kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"u", "http://example.com/"}, {"method", "GET"}}}
+	ev.Sign(sec)
+	ev.Content = "changed after signing"
+	raw, _ := json.Marshal(ev)
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	err := checkNip98Auth(r, base64.StdEncoding.EncodeToString(raw))
+	if err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("checkNip98Auth() error = %v, want invalid signature", err)
+	}
+}
+
+func TestCheckNip98AuthNotConfigured(t *testing.T) {
+	savedPubkeys := adminPubkeys
+	adminPubkeys = map[string]bool{}
+	t.Cleanup(func() { adminPubkeys = savedPubkeys })
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	if err := checkNip98Auth(r, ""); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("checkNip98Auth() error = %v, want not configured", err)
+	}
+}
+
+func TestCheckSameOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		origin  string
+		referer string
+		wantErr bool
+	}{
+		{"get from another site", "GET", "https://evil.example", "", false},
+		{"no origin or referer", "POST", "", "", false},
+		{"same origin", "POST", "http://example.com", "", false},
+		{"same referer", "POST", "", "http://example.com/settings", false},
+		{"host case ignored", "POST", "http://EXAMPLE.com", "", false},
+		{"other origin", "POST", "https://evil.example", "", true},
+		{"other referer", "DELETE", "", "https://evil.example/page", true},
+		{"origin wins over referer", "POST", "https://evil.example", "http://example.com/", true},
+		{"other port", "POST", "http://example.com:8080", "", true},
+		{"opaque origin", "POST", "null", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://example.com/add", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			if err := checkSameOrigin(r); (err != nil) != tt.wantErr {
+				t.Errorf("checkSameOrigin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
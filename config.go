@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -18,10 +20,11 @@ type HooksConfig struct {
 type HookStages struct {
 	PrePostNostrPublish    []NamedHook `yaml:"prePostNostrPublish"`
 	PreNostrProfilePublish []NamedHook `yaml:"preNostrProfilePublish"`
+	PostNostrPublish       []NamedHook `yaml:"postNostrPublish"`
 }
 
 // NamedHook is a generic hook descriptor with a type and name.
-// Currently supported type: "restEnrich"
+// Supported types: "restEnrich", "enrichWithTags", "exec" and "webhook"
 type NamedHook struct {
 	Name string `yaml:"name"`
 	Type string `yaml:"type"`
@@ -35,6 +38,193 @@ type NamedHook struct {
 
 	// EnrichWithTags fields
 	SuggestTagsURL string `yaml:"suggestTagsUrl"`
+
+	// Webhook fields
+	Secret string `yaml:"secret"`
+
+	// Exec hook fields
+	Command      string   `yaml:"command"`
+	Args         []string `yaml:"args"`
+	Env          []string `yaml:"env"`
+	MaxProcesses int      `yaml:"maxProcesses"`
+
+	// Failure policy of every hook type
+	OnError        string                `yaml:"onError"` // abort, skip or defer
+	Retries        *int                  `yaml:"retries"`
+	Timeout        string                `yaml:"timeout"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker"`
+
+	// Feeds the hook runs for, all if not set
+	Feeds *FeedSelectorConfig `yaml:"feeds"`
+}
+
+// FeedSelectorConfig selects feeds by url or npub, url glob, url regex or
+// tag. A feed matching any of them is selected.
+type FeedSelectorConfig struct {
+	List  []string `yaml:"list"`
+	Glob  []string `yaml:"glob"`
+	Regex []string `yaml:"regex"`
+	Tags  []string `yaml:"tags"`
+}
+
+// CircuitBreakerConfig stops calling a hook for Cooldown after Failures
+// failed calls in a row.
+type CircuitBreakerConfig struct {
+	Failures int    `yaml:"failures"`
+	Cooldown string `yaml:"cooldown"`
+}
+
+// scope builds the feed selector of a hook.
+func (h NamedHook) scope() (hookScope, error) {
+	if h.Feeds == nil {
+		return hookScope{}, nil
+	}
+	feeds, err := newFeedSelector(h.Feeds)
+	return hookScope{feeds: feeds}, err
+}
+
+// policy builds the failure policy of a hook. onError defaults to abort,
+// which drops the post like before.
+func (h NamedHook) policy(defaultRetries int) (*hookPolicy, error) {
+	p := &hookPolicy{name: h.Name, onError: h.OnError, retries: defaultRetries, retryDelay: hookRetryDelay, timeout: 10 * time.Second}
+	switch p.onError {
+	case "":
+		p.onError = hookOnErrorAbort
+	case hookOnErrorAbort, hookOnErrorSkip, hookOnErrorDefer:
+	default:
+		return nil, errors.New("invalid onError " + h.OnError + ", expected abort, skip or defer")
+	}
+	if h.Retries != nil {
+		if *h.Retries < 0 {
+			return nil, errors.New("retries can't be negative")
+		}
+		p.retries = *h.Retries
+	}
+	if h.Timeout != "" {
+		timeout, err := time.ParseDuration(h.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, errors.New("invalid timeout " + h.Timeout)
+		}
+		p.timeout = timeout
+	}
+	if h.Type == "exec" {
+		maxProcesses := h.MaxProcesses
+		if maxProcesses <= 0 {
+			maxProcesses = 2
+		}
+		p.slots = make(chan struct{}, maxProcesses)
+	}
+	if h.CircuitBreaker != nil && h.CircuitBreaker.Failures > 0 {
+		p.breakerFailures = h.CircuitBreaker.Failures
+		p.breakerCooldown = 5 * time.Minute
+		if h.CircuitBreaker.Cooldown != "" {
+			cooldown, err := parseDurationWithDays(h.CircuitBreaker.Cooldown)
+			if err != nil || cooldown <= 0 {
+				return nil, errors.New("invalid circuit breaker cooldown " + h.CircuitBreaker.Cooldown)
+			}
+			p.breakerCooldown = cooldown
+		}
+	}
+	return p, nil
+}
+
+// registerHooks creates the hooks of every stage.
+func (a *Atomstr) registerHooks(cfg *HooksConfig) {
+	for _, h := range cfg.Hooks.PrePostNostrPublish {
+		policy, err := h.policy(0)
+		if err != nil {
+			log.Println("[WARN] Ignoring hook", h.Name+":", err)
+			continue
+		}
+		scope, err := h.scope()
+		if err != nil {
+			log.Println("[WARN] Ignoring hook", h.Name+":", err)
+			continue
+		}
+		switch h.Type {
+		case "restEnrich":
+			method := h.Method
+			if method == "" {
+				method = "POST"
+			}
+			hook := NewRestEnrichHook(h.URL, method, h.Headers, h.ComposeRequest, h.ParseResponse)
+			a.RegisterPrePublishHook(&guardedEventHook{hookScope: scope, policy: policy, hook: hook})
+			log.Println("[INFO] Registered prePostNostrPublish hook:", h.Name)
+		case "enrichWithTags":
+			endpoint := h.SuggestTagsURL
+			if endpoint == "" {
+				endpoint = h.URL // allow url alias
+			}
+			a.RegisterPrePublishHook(&guardedEventHook{hookScope: scope, policy: policy, hook: NewEnrichWithTagsHook(endpoint, h.Headers)})
+			log.Println("[INFO] Registered enrichWithTags hook:", h.Name)
+		case "exec":
+			if h.Command == "" {
+				log.Println("[WARN] Ignoring exec hook without command:", h.Name)
+				continue
+			}
+			hook := NewExecHook(h.Command, h.Args, h.Env)
+			a.RegisterPrePublishHook(&guardedEventHook{hookScope: scope, policy: policy, hook: hook})
+			log.Println("[INFO] Registered prePostNostrPublish hook:", h.Name)
+		default:
+			log.Println("[WARN] Hook type", h.Type, "is not supported for prePostNostrPublish:", h.Name)
+		}
+	}
+	for _, h := range cfg.Hooks.PreNostrProfilePublish {
+		policy, err := h.policy(0)
+		if err != nil {
+			log.Println("[WARN] Ignoring hook", h.Name+":", err)
+			continue
+		}
+		scope, err := h.scope()
+		if err != nil {
+			log.Println("[WARN] Ignoring hook", h.Name+":", err)
+			continue
+		}
+		switch h.Type {
+		case "restEnrich":
+			hook := NewRestEnrichHook(h.URL, h.Method, h.Headers, h.ComposeRequest, h.ParseResponse)
+			a.RegisterPreProfilePublishHook(&guardedProfileHook{hookScope: scope, policy: policy, hook: hook})
+			log.Println("[INFO] Registered preNostrProfilePublish hook:", h.Name)
+		case "exec":
+			if h.Command == "" {
+				log.Println("[WARN] Ignoring exec hook without command:", h.Name)
+				continue
+			}
+			hook := NewExecHook(h.Command, h.Args, h.Env)
+			a.RegisterPreProfilePublishHook(&guardedProfileHook{hookScope: scope, policy: policy, hook: hook})
+			log.Println("[INFO] Registered preNostrProfilePublish hook:", h.Name)
+		default:
+			log.Println("[WARN] Hook type", h.Type, "is not supported for preNostrProfilePublish:", h.Name)
+		}
+	}
+	for _, h := range cfg.Hooks.PostNostrPublish {
+		policy, err := h.policy(3)
+		if err != nil {
+			log.Println("[WARN] Ignoring hook", h.Name+":", err)
+			continue
+		}
+		scope, err := h.scope()
+		if err != nil {
+			log.Println("[WARN] Ignoring hook", h.Name+":", err)
+			continue
+		}
+		switch h.Type {
+		case "webhook":
+			secret := h.Secret
+			if strings.HasPrefix(secret, "$") {
+				secret = os.Getenv(secret[1:])
+				if secret == "" {
+					log.Println("[WARN] Ignoring hook", h.Name+": secret specified an env, but env variable not found:", h.Secret[1:])
+					continue
+				}
+			}
+			hook := NewWebhookHook(h.URL, h.Headers, secret)
+			a.RegisterPostPublishHook(&guardedPostPublishHook{hookScope: scope, policy: policy, hook: hook})
+			log.Println("[INFO] Registered postNostrPublish hook:", h.Name)
+		default:
+			log.Println("[WARN] Hook type", h.Type, "is not supported for postNostrPublish:", h.Name)
+		}
+	}
 }
 
 func loadHooksConfig(path string) (*HooksConfig, error) {
@@ -47,10 +237,21 @@ func loadHooksConfig(path string) (*HooksConfig, error) {
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, err
 	}
-	log.Printf("[DEBUG] Parsed hooks config: %+v", cfg.Hooks)
+	// hooks may carry secrets and headers, only log what they are
+	log.Printf("[DEBUG] Parsed hooks config: prePostNostrPublish [%s], preNostrProfilePublish [%s], postNostrPublish [%s]",
+		hookNames(cfg.Hooks.PrePostNostrPublish), hookNames(cfg.Hooks.PreNostrProfilePublish), hookNames(cfg.Hooks.PostNostrPublish))
 	return cfg, nil
 }
 
+// hookNames lists the names and types of hooks for logging.
+func hookNames(hooks []NamedHook) string {
+	names := make([]string, len(hooks))
+	for i, h := range hooks {
+		names[i] = h.Name + " (" + h.Type + ")"
+	}
+	return strings.Join(names, ", ")
+}
+
 func findDefaultHooksConfig() (string, error) {
 	// prefer HOOKS_CONFIG_PATH, otherwise look for hooks.yaml in CWD
 	if p := os.Getenv("HOOKS_CONFIG_PATH"); p != "" {
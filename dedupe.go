@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// Dedupe strategies decide which part of a post identity marks it as already
+// published.
+const (
+	dedupeAuto    = "auto"    // GUID, else normalized link if unique in the fetch, else content hash
+	dedupeGUID    = "guid"    // GUID only, content hash if the item has none
+	dedupeLink    = "link"    // normalized link only, content hash if the item has none
+	dedupeContent = "content" // content hash only
+)
+
+var dedupeStrategies = []string{dedupeAuto, dedupeGUID, dedupeLink, dedupeContent}
+
+// trackingParams are query parameters stripped from links before comparing them.
+var trackingParams = map[string]bool{
+	"fbclid": true, "gclid": true, "dclid": true, "yclid": true, "msclkid": true,
+	"mc_cid": true, "mc_eid": true, "igshid": true, "ref": true, "ref_src": true,
+	"_hsenc": true, "_hsmi": true, "mkt_tok": true, "spm": true,
+}
+
+// postIdentity is everything we know to recognize a feed post again.
+type postIdentity struct {
+	FeedUrl        string
+	Link           string
+	GUID           string
+	NormalizedLink string
+	ContentHash    string
+	LinkShared     bool // other posts of the same fetch have the same link
+}
+
+func newPostIdentity(feedUrl string, feedPost *gofeed.Item) postIdentity {
+	return postIdentity{
+		FeedUrl:        feedUrl,
+		Link:           feedPost.Link,
+		GUID:           strings.TrimSpace(feedPost.GUID),
+		NormalizedLink: normalizeLink(feedPost.Link),
+		ContentHash:    contentHash(feedPost),
+	}
+}
+
+// newPostIdentities returns the identities of all posts of one fetch and
+// marks links that more than one of them share.
+func newPostIdentities(feedUrl string, feedPosts []*gofeed.Item) []postIdentity {
+	ids := make([]postIdentity, len(feedPosts))
+	links := map[string]int{}
+	for i, feedPost := range feedPosts {
+		ids[i] = newPostIdentity(feedUrl, feedPost)
+		if ids[i].NormalizedLink != "" {
+			links[ids[i].NormalizedLink]++
+		}
+	}
+	for i := range ids {
+		ids[i].LinkShared = links[ids[i].NormalizedLink] > 1
+	}
+	return ids
+}
+
+// normalizeLink lowercases scheme and host, drops the fragment and removes
+// tracking query parameters so that the same article is recognized even if
+// the feed rotates them.
+func normalizeLink(link string) string {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return ""
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	q := u.Query()
+	for key := range q {
+		if strings.HasPrefix(strings.ToLower(key), "utm_") || trackingParams[strings.ToLower(key)] {
+			q.Del(key)
+		}
+	}
+	u.RawQuery = q.Encode() // Encode sorts by key
+	return u.String()
+}
+
+// contentHash hashes the visible content of a post.
+func contentHash(feedPost *gofeed.Item) string {
+	h := sha256.New()
+	h.Write([]byte(strings.TrimSpace(feedPost.Title)))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.TrimSpace(feedPost.Description)))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.TrimSpace(feedPost.Content)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dedupeKey returns the column and value compared for the given strategy.
+func (id postIdentity) dedupeKey(strategy string) (string, string) {
+	switch strategy {
+	case dedupeGUID:
+		if id.GUID != "" {
+			return "guid", id.GUID
+		}
+	case dedupeLink:
+		if id.NormalizedLink != "" {
+			return "normalized_url", id.NormalizedLink
+		}
+	case dedupeContent:
+	default:
+		if id.GUID != "" {
+			return "guid", id.GUID
+		}
+		if id.NormalizedLink != "" && !id.LinkShared {
+			return "normalized_url", id.NormalizedLink
+		}
+	}
+	return "content_hash", id.ContentHash
+}
+
+// dbCheckPublishedPost reports whether a post with the same identity was
+// already published by the feed. Posts recorded before identities existed
+// only have a link, normalized by migration 7, and are matched by it.
+func (a *Atomstr) dbCheckPublishedPost(id postIdentity, strategy string) bool {
+	column, value := id.dedupeKey(strategy)
+	sqlStatement := `SELECT COUNT(*) FROM published_posts WHERE feed_url=? AND (` + column + `=? OR (normalized_url<>'' AND normalized_url=? AND guid='' AND content_hash=''));`
+	row := a.db.QueryRow(sqlStatement, id.FeedUrl, value, id.NormalizedLink)
+
+	var count int
+	err := row.Scan(&count)
+	if err != nil {
+		log.Println("[ERROR] Failed to check published post:", err)
+		return false
+	}
+	return count > 0
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestNormalizeLink(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{"empty", "", ""},
+		{"blank", "   ", ""},
+		{"unchanged", "https://example.com/post/1", "https://example.com/post/1"},
+		{"trimmed", "  https://example.com/a  ", "https://example.com/a"},
+		{"scheme and host lowercased", "HTTPS://Example.COM/Post", "https://example.com/Post"},
+		{"fragment dropped", "https://example.com/a#comments", "https://example.com/a"},
+		{"utm params dropped", "https://example.com/a?utm_source=rss&utm_medium=feed", "https://example.com/a"},
+		{"tracking params dropped", "https://example.com/a?fbclid=x&ref=rss&id=3", "https://example.com/a?id=3"},
+		{"uppercase tracking params dropped", "https://example.com/a?UTM_Campaign=x&FBCLID=y", "https://example.com/a"},
+		{"query sorted", "https://example.com/a?b=2&a=1", "https://example.com/a?a=1&b=2"},
+		{"unparsable kept", "http://[::1", "http://[::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeLink(tt.link); got != tt.want {
+				t.Errorf("normalizeLink(%q) = %q, want %q", tt.link, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	base := &gofeed.Item{Title: "Title", Description: "Description", Content: "Content"}
+	tests := []struct {
+		name string
+		item *gofeed.Item
+		same bool
+	}{
+		{"identical", &gofeed.Item{Title: "Title", Description: "Description", Content: "Content"}, true},
+		{"surrounding whitespace ignored", &gofeed.Item{Title: " Title\n", Description: "Description ", Content: "\tContent"}, true},
+		{"link ignored", &gofeed.Item{Title: "Title", Description: "Description", Content: "Content", Link: "https://example.com/a"}, true},
+		{"title changed", &gofeed.Item{Title: "Other", Description: "Description", Content: "Content"}, false},
+		{"content changed", &gofeed.Item{Title: "Title", Description: "Description", Content: "Other"}, false},
+		{"fields not concatenated", &gofeed.Item{Title: "TitleDescription", Content: "Content"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentHash(tt.item) == contentHash(base); got != tt.same {
+				t.Errorf("contentHash equal = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestDedupeKey(t *testing.T) {
+	full := postIdentity{GUID: "guid-1", NormalizedLink: "https://example.com/a", ContentHash: "hash"}
+	noGUID := postIdentity{NormalizedLink: "https://example.com/a", ContentHash: "hash"}
+	hashOnly := postIdentity{ContentHash: "hash"}
+	sharedLink := postIdentity{NormalizedLink: "https://example.com/a", ContentHash: "hash", LinkShared: true}
+
+	tests := []struct {
+		name       string
+		id         postIdentity
+		strategy   string
+		wantColumn string
+		wantValue  string
+	}{
+		{"auto prefers guid", full, dedupeAuto, "guid", "guid-1"},
+		{"auto falls back to link", noGUID, dedupeAuto, "normalized_url", "https://example.com/a"},
+		{"auto falls back to hash", hashOnly, dedupeAuto, "content_hash", "hash"},
+		{"auto with shared link uses hash", sharedLink, dedupeAuto, "content_hash", "hash"},
+		{"auto with shared link prefers guid", postIdentity{GUID: "guid-1", NormalizedLink: "https://example.com/a", LinkShared: true}, dedupeAuto, "guid", "guid-1"},
+		{"link with shared link", sharedLink, dedupeLink, "normalized_url", "https://example.com/a"},
+		{"unknown strategy works like auto", full, "", "guid", "guid-1"},
+		{"guid", full, dedupeGUID, "guid", "guid-1"},
+		{"guid without guid uses hash", noGUID, dedupeGUID, "content_hash", "hash"},
+		{"link", full, dedupeLink, "normalized_url", "https://example.com/a"},
+		{"link without link uses hash", hashOnly, dedupeLink, "content_hash", "hash"},
+		{"content", full, dedupeContent, "content_hash", "hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			column, value := tt.id.dedupeKey(tt.strategy)
+			if column != tt.wantColumn || value != tt.wantValue {
+				t.Errorf("dedupeKey(%q) = %q, %q, want %q, %q", tt.strategy, column, value, tt.wantColumn, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestNewPostIdentities(t *testing.T) {
+	items := []*gofeed.Item{
+		{Link: "https://example.com/a?utm_source=rss", Title: "One"},
+		{Link: "https://example.com/a#two", Title: "Two"},
+		{Link: "https://example.com/b", Title: "Three"},
+		{Title: "Four"},
+		{Title: "Five"},
+	}
+	want := []bool{true, true, false, false, false}
+
+	ids := newPostIdentities("https://example.com/feed", items)
+	if len(ids) != len(items) {
+		t.Fatalf("got %d identities, want %d", len(ids), len(items))
+	}
+	for i, id := range ids {
+		if id.LinkShared != want[i] {
+			t.Errorf("identity %d LinkShared = %v, want %v", i, id.LinkShared, want[i])
+		}
+	}
+	if ids[0].key() == ids[1].key() {
+		t.Errorf("posts sharing a link have the same key %q", ids[0].key())
+	}
+}
+
+func TestDbCheckPublishedPost(t *testing.T) {
+	db := openTestDB(t)
+	if err := dbMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+	a := &Atomstr{db: db}
+
+	const feedUrl = "https://example.com/feed"
+	published := &gofeed.Item{GUID: "guid-1", Link: "https://example.com/a?utm_source=rss", Title: "A", Content: "First"}
+	if !a.dbRecordPublishedPost(newPostIdentity(feedUrl, published), nostr.Event{ID: "event-a", Kind: nostr.KindTextNote}) {
+		t.Fatal("failed to record post")
+	}
+	// a post recorded before migration 7, see TestMigratePublishedPostIdentities
+	_, err := db.Exec(`INSERT INTO published_posts (url, feed_url, normalized_url, published_at, nostr_event_id) VALUES (?, ?, ?, ?, ?)`,
+		"https://example.com/legacy?fbclid=x", feedUrl, "https://example.com/legacy", 1, "event-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		feedUrl  string
+		item     *gofeed.Item
+		strategy string
+		want     bool
+	}{
+		{"same guid", feedUrl, &gofeed.Item{GUID: "guid-1", Link: "https://example.com/moved", Title: "Edited"}, dedupeAuto, true},
+		{"other guid", feedUrl, &gofeed.Item{GUID: "guid-2", Link: "https://example.com/a", Title: "A", Content: "First"}, dedupeAuto, false},
+		{"link without tracking params", feedUrl, &gofeed.Item{Link: "https://example.com/a?utm_medium=feed"}, dedupeAuto, true},
+		{"link strategy ignores guid", feedUrl, &gofeed.Item{GUID: "guid-2", Link: "https://Example.com/a#top"}, dedupeLink, true},
+		{"same content", feedUrl, &gofeed.Item{Title: "A", Content: "First"}, dedupeContent, true},
+		{"other content", feedUrl, &gofeed.Item{Title: "A", Content: "Second"}, dedupeContent, false},
+		{"legacy post by normalized link", feedUrl, &gofeed.Item{GUID: "guid-3", Link: "https://example.com/legacy?utm_source=x"}, dedupeAuto, true},
+		{"legacy post with content strategy", feedUrl, &gofeed.Item{Link: "https://example.com/legacy", Title: "L"}, dedupeContent, true},
+		{"other feed", "https://example.org/feed", &gofeed.Item{GUID: "guid-1", Link: "https://example.com/a"}, dedupeAuto, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.dbCheckPublishedPost(newPostIdentity(tt.feedUrl, tt.item), tt.strategy); got != tt.want {
+				t.Errorf("dbCheckPublishedPost = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("shared link", func(t *testing.T) {
+		siblings := newPostIdentities(feedUrl, []*gofeed.Item{
+			{Link: "https://example.com/shared", Title: "One"},
+			{Link: "https://example.com/shared", Title: "Two"},
+		})
+		if !a.dbRecordPublishedPost(siblings[0], nostr.Event{ID: "event-shared", Kind: nostr.KindTextNote}) {
+			t.Fatal("failed to record post")
+		}
+		if !a.dbCheckPublishedPost(siblings[0], dedupeAuto) {
+			t.Error("recorded post not found")
+		}
+		if a.dbCheckPublishedPost(siblings[1], dedupeAuto) {
+			t.Error("post sharing the link of a published post counted as published")
+		}
+	})
+}
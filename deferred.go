@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// deferredPost is a post a hook asked to publish later. It is retried on the
+// outbox schedule and given up after OUTBOX_GIVE_UP.
+type deferredPost struct {
+	FeedUrl   string
+	Key       string
+	Item      *gofeed.Item
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// key identifies a post of a feed: its GUID, link or content hash.
+func (id postIdentity) key() string {
+	if id.GUID != "" {
+		return id.GUID
+	}
+	if id.Link != "" && !id.LinkShared {
+		return id.Link
+	}
+	return id.ContentHash
+}
+
+// retryDeferredPosts publishes deferred posts that are due. Posts of paused
+// feeds wait until the feed is resumed.
+func (a *Atomstr) retryDeferredPosts(ctx context.Context) {
+	posts := a.dbGetDueDeferredPosts()
+	if len(posts) == 0 {
+		return
+	}
+	log.Printf("[INFO] Retrying %d deferred posts\n", len(posts))
+	for _, post := range posts {
+		if ctx.Err() != nil {
+			return
+		}
+		feedItem := a.dbGetFeed(post.FeedUrl)
+		if feedItem.Url == "" {
+			a.dbDeleteDeferredPost(post.FeedUrl, post.Key)
+			continue
+		}
+		if feedItem.State != feedActive {
+			continue
+		}
+		if time.Since(post.CreatedAt) > outboxGiveUp {
+			log.Printf("[WARN] Giving up on deferred post %s after %d attempts\n", post.Item.Link, post.Attempts)
+			a.dbDeleteDeferredPost(post.FeedUrl, post.Key)
+			continue
+		}
+		if !a.sched.tryLockFeed(feedItem.Url) {
+			continue // busy, try again next time
+		}
+		id := newPostIdentity(feedItem.Url, post.Item)
+		// the key of a post whose link was shared is its content hash
+		id.LinkShared = id.GUID == "" && post.Key == id.ContentHash
+		if a.dbCheckPublishedPost(id, feedItem.Dedupe) {
+			a.dbDeleteDeferredPost(post.FeedUrl, post.Key)
+		} else if a.publishFeedPost(ctx, *feedItem, post.Item, id) != postDeferred {
+			a.dbDeleteDeferredPost(post.FeedUrl, post.Key)
+		}
+		a.sched.unlockFeed(feedItem.Url)
+	}
+}
+
+// dbDeferPost stores a post for a later retry. Deferring it again counts as
+// another attempt and backs off like outbox deliveries.
+func (a *Atomstr) dbDeferPost(feedUrl string, feedPost *gofeed.Item, id postIdentity, reason error) {
+	itemJSON, err := json.Marshal(feedPost)
+	if err != nil {
+		log.Println("[ERROR] Failed to encode deferred post:", err)
+		return
+	}
+
+	var attempts int
+	row := a.db.QueryRow(`SELECT attempts FROM deferred_posts WHERE feed_url=? AND post_key=?;`, feedUrl, id.key())
+	if err := row.Scan(&attempts); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Println("[ERROR] Failed to read deferred posts:", err)
+	}
+	backoff := outboxBackoffMin << attempts
+	if backoff > outboxBackoffMax || backoff <= 0 {
+		backoff = outboxBackoffMax
+	}
+
+	now := time.Now()
+	sqlStatement := `INSERT INTO deferred_posts (feed_url, post_key, item, attempts, last_error, created_at, next_attempt_at) VALUES (?, ?, ?, 1, ?, ?, ?)
+	ON CONFLICT(feed_url, post_key) DO UPDATE SET item=excluded.item, attempts=attempts+1, last_error=excluded.last_error, next_attempt_at=excluded.next_attempt_at;`
+	_, err = a.db.Exec(sqlStatement, feedUrl, id.key(), string(itemJSON), reason.Error(), now.Unix(), now.Add(backoff).Unix())
+	if err != nil {
+		log.Println("[ERROR] Failed to store deferred post:", err)
+	}
+}
+
+func (a *Atomstr) dbGetDueDeferredPosts() []deferredPost {
+	sqlStatement := `SELECT feed_url, post_key, item, attempts, created_at FROM deferred_posts WHERE next_attempt_at<=? ORDER BY next_attempt_at;`
+	rows, err := a.db.Query(sqlStatement, time.Now().Unix())
+	if err != nil {
+		log.Println("[ERROR] Failed to read deferred posts:", err)
+		return nil
+	}
+	defer rows.Close()
+
+	posts := []deferredPost{}
+	for rows.Next() {
+		post := deferredPost{}
+		var itemJSON string
+		var createdAt int64
+		if err := rows.Scan(&post.FeedUrl, &post.Key, &itemJSON, &post.Attempts, &createdAt); err != nil {
+			log.Println("[ERROR] Scanning deferred posts failed:", err)
+			return nil
+		}
+		if err := json.Unmarshal([]byte(itemJSON), &post.Item); err != nil {
+			log.Println("[ERROR] Decoding deferred post failed:", err)
+			continue
+		}
+		post.CreatedAt = time.Unix(createdAt, 0)
+		posts = append(posts, post)
+	}
+	return posts
+}
+
+func (a *Atomstr) dbDeleteDeferredPost(feedUrl, key string) {
+	_, err := a.db.Exec(`DELETE FROM deferred_posts WHERE feed_url=? AND post_key=?;`, feedUrl, key)
+	if err != nil {
+		log.Println("[ERROR] Failed to delete deferred post:", err)
+	}
+}
+
+func (a *Atomstr) dbDeleteDeferredPosts(feedUrl string) {
+	_, err := a.db.Exec(`DELETE FROM deferred_posts WHERE feed_url=?;`, feedUrl)
+	if err != nil {
+		log.Println("[ERROR] Failed to delete deferred posts:", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mmcdole/gofeed"
@@ -22,43 +23,92 @@ var r = getEnv("RELAYS_TO_PUBLISH_TO", "wss://nostr.data.haus, wss://nos.lol, ws
 var relaysToPublishTo = strings.Split(r, ", ")
 var defaultFeedImage = getEnv("DEFAULT_FEED_IMAGE", "https://void.cat/d/NDrSDe4QMx9jh6bD9LJwcK")
 var dbPath = getEnv("DB_PATH", "./atomstr.db")
+var outboxRetryInterval, _ = time.ParseDuration(getEnv("OUTBOX_RETRY_INTERVAL", "1m"))
+var outboxGiveUp, _ = parseDurationWithDays(getEnv("OUTBOX_GIVE_UP", "3d"))
+var adminToken = getEnv("ADMIN_TOKEN", "")
+var adminUser = getEnv("ADMIN_USER", "")
+var adminPassword = getEnv("ADMIN_PASSWORD", "")
+var adminPubkeys = parseAdminNpubs(getEnv("ADMIN_NPUBS", ""))
+var adminAuthDisabled, _ = strconv.ParseBool(getEnv("ADMIN_AUTH_DISABLED", "false"))
+var trustProxyHeaders, _ = strconv.ParseBool(getEnv("TRUST_PROXY_HEADERS", "false"))
+var adaptiveMinInterval, _ = parseDurationWithDays(getEnv("ADAPTIVE_MIN_INTERVAL", "5m"))
+var adaptiveMaxInterval, _ = parseDurationWithDays(getEnv("ADAPTIVE_MAX_INTERVAL", "1d"))
+var feedBackoffMax, _ = parseDurationWithDays(getEnv("FEED_BACKOFF_MAX", "1d"))
+var feedDisableAfter, _ = parseDurationWithDays(getEnv("FEED_DISABLE_AFTER", "7d"))
+var userAgent = getEnv("USER_AGENT", "atomstr/"+atomstrversion+" (+https://git.sr.ht/~psic4t/atomstr)")
+var hostMaxConnections, _ = strconv.Atoi(getEnv("HOST_MAX_CONNECTIONS", "2"))
+var hostMinDelay, _ = time.ParseDuration(getEnv("HOST_MIN_DELAY", "1s"))
+var shutdownTimeout, _ = time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "30s"))
 var noPub, _ = strconv.ParseBool(getEnv("NOPUB", "false"))
 var atomstrversion string = "0.9.6"
 
 type Atomstr struct {
 	db *sql.DB
+	// Long-lived relay connections shared by all workers
+	relays *relayPool
 	// Registered hooks invoked before publishing/signing a Nostr event
 	prePublishHooks []NostrEventHook
+	// Registered hooks invoked before publishing/signing a feed profile
+	preProfilePublishHooks []NostrProfileHook
+	// Registered hooks invoked after a post was published
+	postPublishHooks []NostrPostPublishHook
+	// Posts waiting for their post-publish hooks and the workers running them
+	postPublishQueue   chan postPublishTask
+	postPublishMu      sync.Mutex
+	postPublishRunning int
+	// Wakes up the job runner when a new job was queued
+	jobWake chan struct{}
+	// Feeds fetched when they were added, waiting for their add-feed jobs
+	jobFeedsMu sync.Mutex
+	jobFeeds   map[string]*feedStruct
+	// Background goroutines drained on shutdown
+	wg sync.WaitGroup
+	// Running scrape and metadata runs and busy feeds
+	sched *scheduler
 }
 
-var sqlInit = `
-CREATE TABLE IF NOT EXISTS feeds (
-	pub VARCHAR(64) PRIMARY KEY,
-	sec VARCHAR(64) NOT NULL,
-	url TEXT NOT NULL
-);
-CREATE TABLE IF NOT EXISTS published_posts (
-	url TEXT PRIMARY KEY,
-	feed_url TEXT NOT NULL,
-	published_at INTEGER NOT NULL,
-	nostr_event_id TEXT NOT NULL,
-	FOREIGN KEY (feed_url) REFERENCES feeds(url)
-);
-CREATE INDEX IF NOT EXISTS idx_published_posts_feed_url ON published_posts(feed_url);
-CREATE INDEX IF NOT EXISTS idx_published_posts_published_at ON published_posts(published_at);
-CREATE INDEX IF NOT EXISTS idx_published_posts_nostr_event_id ON published_posts(nostr_event_id);
-`
-
 type feedStruct struct {
-	Url         string         `json:"url"`
-	Sec         string         `json:"-"`
-	Pub         string         `json:"pub"`
-	Npub        string         `json:"npub"`
-	Title       string         `json:"title"`
-	Description string         `json:"description"`
-	Link        string         `json:"link"`
-	Image       string         `json:"image"`
-	Posts       []*gofeed.Item `json:"-"`
+	Url          string         `json:"url"`
+	Sec          string         `json:"-"`
+	Pub          string         `json:"pub"`
+	Npub         string         `json:"npub"`
+	Title        string         `json:"title"`
+	Description  string         `json:"description"`
+	Link         string         `json:"link"`
+	Image        string         `json:"image"`
+	Relays       []string       `json:"relays"`
+	Tags         []string       `json:"tags"` // for the feed selectors of hooks
+	Mode         string         `json:"mode"`
+	Dedupe       string         `json:"dedupe"`
+	Interval     string         `json:"interval"`      // fetch interval, empty for FETCH_INTERVAL
+	PostInterval int64          `json:"post_interval"` // learned seconds between posts
+	NextFetch    int64          `json:"next_fetch_at"`
+	State        string         `json:"state"`
+	ErrorCount   int            `json:"error_count"`          // failed fetches in a row
+	LastError    string         `json:"last_error,omitempty"` // of the latest failed fetch
+	FailingSince int64          `json:"failing_since,omitempty"`
+	LastSuccess  int64          `json:"last_success_at"`
+	Posts        []*gofeed.Item `json:"-"`
+}
+
+// Feed publishing modes
+const (
+	feedModeNote           = "note"            // kind 1 text notes
+	feedModeLongform       = "longform"        // NIP-23 kind 30023 articles
+	feedModeLongformTeaser = "longform-teaser" // articles plus a kind 1 teaser
+)
+
+var feedModes = []string{feedModeNote, feedModeLongform, feedModeLongformTeaser}
+
+// feedSettings are the per-feed options that can be given when adding or
+// updating a feed. Nil fields keep their current (or default) value.
+type feedSettings struct {
+	Relays   *[]string
+	Tags     *[]string
+	Mode     *string
+	Dedupe   *string
+	Interval *string
+	Sec      string `json:"-"` // secret key of a new feed, ignored on updates
 }
 
 // feedPostStruct is a stable representation of a single feed post for external APIs.
@@ -71,14 +121,23 @@ type feedPostStruct struct {
 	PublishedUnix int64    `json:"published_unix"`
 	Categories    []string `json:"categories"`
 	Enclosures    []string `json:"enclosures"`
+	NostrEventId  string   `json:"nostr_event_id,omitempty"`
 }
 
 type webIndex struct {
-	Relays  []string
-	Feeds   []feedStruct
-	Version string
+	Relays          []relayStatus
+	DefaultRelays   []string
+	Modes           []string
+	Dedupes         []string
+	DefaultInterval string
+	Feeds           []feedStruct
+	Runs            []runStruct
+	Version         string
 }
 type webAddFeed struct {
-	Status string
-	Feed   feedStruct
+	Status     string
+	Feed       feedStruct
+	Candidates []feedCandidate
+	Job        *jobStruct
+	Form       map[string]string // settings to submit again with a candidate
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// deletionBatchSize limits the number of events referenced by one NIP-09
+// deletion event.
+const deletionBatchSize = 100
+
+// publishedPostRef is a recorded post that can be deleted.
+type publishedPostRef struct {
+	Id            int64
+	Link          string
+	FeedUrl       string
+	GUID          string
+	NostrEventId  string
+	ArticleD      string // d tag of an article
+	TeaserEventId string // teaser note of an article
+}
+
+// deletePost retracts a published post, given by its link, event ID, note
+// or nevent. The post stays recorded, so it is not published again.
+func (a *Atomstr) deletePost(ctx context.Context, ref string) error {
+	posts := a.dbFindPublishedPosts(ref)
+	if len(posts) == 0 {
+		log.Println("[WARN] post not found")
+		return errors.New("post not found")
+	}
+
+	for _, post := range posts {
+		feedItem := a.dbGetFeed(post.FeedUrl)
+		if feedItem.Url == "" {
+			log.Println("[WARN] Feed of", post.Link, "was removed, can't sign a deletion")
+			continue
+		}
+
+		a.nostrPublishDeletion(ctx, feedItem, a.postDeletionTags(feedItem, post), "post removed")
+		a.dbMarkPostDeleted(post.Id)
+		log.Println("[INFO] Deleted post", post.Link, "of", feedItem.Url)
+	}
+	return nil
+}
+
+// postDeletionTags references the events of a recorded post: the note or
+// article and the teaser of an article. Posts recorded before article
+// references were stored fall back to the outbox.
+func (a *Atomstr) postDeletionTags(feedItem *feedStruct, post publishedPostRef) nostr.Tags {
+	tags := nostr.Tags{{"e", post.NostrEventId}}
+	if post.ArticleD != "" {
+		tags = append(tags, nostr.Tag{"a", strconv.Itoa(nostr.KindArticle) + ":" + feedItem.Pub + ":" + post.ArticleD})
+		if post.TeaserEventId != "" {
+			tags = append(tags, nostr.Tag{"e", post.TeaserEventId})
+		}
+		return tags
+	}
+	if !feedItem.isLongform() {
+		return tags
+	}
+
+	identifier := post.GUID
+	if identifier == "" {
+		identifier = post.Link
+	}
+	address := strconv.Itoa(nostr.KindArticle) + ":" + feedItem.Pub + ":" + identifier
+	tags = append(tags, nostr.Tag{"a", address})
+	// the teaser of an article refers to it by its address
+	for _, ev := range a.dbGetOutboxEvents(feedItem.Url) {
+		if ev.Kind == nostr.KindTextNote && ev.Tags.GetFirst([]string{"a", address}) != nil {
+			tags = append(tags, nostr.Tag{"e", ev.ID})
+		}
+	}
+	return tags
+}
+
+// purgeFeed retracts everything a feed published and blanks its profile.
+func (a *Atomstr) purgeFeed(ctx context.Context, feedItem *feedStruct) {
+	tags := nostr.Tags{}
+	seen := map[string]bool{}
+	addTag := func(tag nostr.Tag) {
+		if !seen[tag[1]] {
+			seen[tag[1]] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, post := range a.dbGetPublishedPostRefs(feedItem.Url) {
+		if post.NostrEventId == "" {
+			continue
+		}
+		addTag(nostr.Tag{"e", post.NostrEventId})
+		if post.ArticleD != "" {
+			addTag(nostr.Tag{"a", strconv.Itoa(nostr.KindArticle) + ":" + feedItem.Pub + ":" + post.ArticleD})
+		}
+		if post.TeaserEventId != "" {
+			addTag(nostr.Tag{"e", post.TeaserEventId})
+		}
+	}
+	// events still in the outbox, e.g. teasers recorded before article
+	// references were stored
+	for _, ev := range a.dbGetOutboxEvents(feedItem.Url) {
+		switch ev.Kind {
+		case nostr.KindProfileMetadata, nostr.KindRelayListMetadata, nostr.KindDeletion:
+			// replaced by the blank profile below, or nothing to retract
+		case nostr.KindArticle:
+			addTag(nostr.Tag{"e", ev.ID})
+			addTag(nostr.Tag{"a", strconv.Itoa(ev.Kind) + ":" + ev.PubKey + ":" + ev.Tags.GetD()})
+		default:
+			addTag(nostr.Tag{"e", ev.ID})
+		}
+	}
+
+	log.Printf("[INFO] Purging %d events of %s\n", len(tags), feedItem.Url)
+	for start := 0; start < len(tags); start += deletionBatchSize {
+		end := min(start+deletionBatchSize, len(tags))
+		a.nostrPublishDeletion(ctx, feedItem, tags[start:end], "feed removed")
+	}
+
+	content, _ := json.Marshal(map[string]string{"name": "", "about": "", "picture": "", "nip05": ""})
+	ev := nostr.Event{
+		PubKey:    feedItem.Pub,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindProfileMetadata,
+		Tags:      nostr.Tags{},
+		Content:   string(content),
+	}
+	ev.Sign(feedItem.Sec)
+	if noPub {
+		log.Println("[DEBUG] not publishing blank profile", ev)
+		return
+	}
+	publishedCount, errCount := a.nostrPublishDurable(ctx, ev, feedItem.Url, feedItem.publishRelays())
+	log.Printf("[DEBUG] Published blank profile to %d / %d relays\n", publishedCount, errCount+publishedCount)
+}
+
+// nostrPublishDeletion signs and publishes a NIP-09 deletion of the events
+// in tags.
+func (a *Atomstr) nostrPublishDeletion(ctx context.Context, feedItem *feedStruct, tags nostr.Tags, reason string) {
+	ev := nostr.Event{
+		PubKey:    feedItem.Pub,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindDeletion,
+		Tags:      tags,
+		Content:   reason,
+	}
+	ev.Sign(feedItem.Sec)
+
+	if noPub {
+		log.Println("[DEBUG] not publishing deletion", ev)
+		return
+	}
+	publishedCount, errCount := a.nostrPublishDurable(ctx, ev, feedItem.Url, feedItem.publishRelays())
+	log.Printf("[DEBUG] Published deletion to %d / %d relays\n", publishedCount, errCount+publishedCount)
+}
+
+// dbFindPublishedPosts looks up recorded posts by event ID or link.
+func (a *Atomstr) dbFindPublishedPosts(ref string) []publishedPostRef {
+	eventId := ref
+	if prefix, value, err := nip19.Decode(ref); err == nil {
+		switch prefix {
+		case "note":
+			eventId = value.(string)
+		case "nevent":
+			eventId = value.(nostr.EventPointer).ID
+		}
+	}
+
+	sqlStatement := `SELECT id, url, feed_url, guid, nostr_event_id, article_d, teaser_event_id FROM published_posts WHERE deleted_at=0 AND (nostr_event_id=? OR url=? OR normalized_url=?);`
+	rows, err := a.db.Query(sqlStatement, eventId, ref, normalizeLink(ref))
+	if err != nil {
+		log.Println("[ERROR] Failed to read published posts:", err)
+		return nil
+	}
+	return scanPublishedPostRefs(rows)
+}
+
+// dbGetPublishedPostRefs returns the recorded posts of a feed that were not
+// deleted.
+func (a *Atomstr) dbGetPublishedPostRefs(feedUrl string) []publishedPostRef {
+	sqlStatement := `SELECT id, url, feed_url, guid, nostr_event_id, article_d, teaser_event_id FROM published_posts WHERE feed_url=? AND deleted_at=0;`
+	rows, err := a.db.Query(sqlStatement, feedUrl)
+	if err != nil {
+		log.Println("[ERROR] Failed to read published posts:", err)
+		return nil
+	}
+	return scanPublishedPostRefs(rows)
+}
+
+func scanPublishedPostRefs(rows *sql.Rows) []publishedPostRef {
+	defer rows.Close()
+	posts := []publishedPostRef{}
+	for rows.Next() {
+		post := publishedPostRef{}
+		if err := rows.Scan(&post.Id, &post.Link, &post.FeedUrl, &post.GUID, &post.NostrEventId, &post.ArticleD, &post.TeaserEventId); err != nil {
+			log.Println("[ERROR] Scanning published posts failed:", err)
+			return nil
+		}
+		posts = append(posts, post)
+	}
+	return posts
+}
+
+func (a *Atomstr) dbMarkPostDeleted(id int64) {
+	_, err := a.db.Exec(`UPDATE published_posts SET deleted_at=? WHERE id=?;`, time.Now().Unix(), id)
+	if err != nil {
+		log.Println("[ERROR] Failed to mark post as deleted:", err)
+	}
+}
+
+// dbGetOutboxEvents returns the events of a feed that are still in the
+// outbox, one per event ID.
+func (a *Atomstr) dbGetOutboxEvents(feedUrl string) []nostr.Event {
+	rows, err := a.db.Query(`SELECT event FROM outbox WHERE feed_url=? GROUP BY event_id;`, feedUrl)
+	if err != nil {
+		log.Println("[ERROR] Failed to read outbox:", err)
+		return nil
+	}
+	defer rows.Close()
+
+	events := []nostr.Event{}
+	for rows.Next() {
+		var evJSON string
+		if err := rows.Scan(&evJSON); err != nil {
+			log.Println("[ERROR] Scanning outbox failed:", err)
+			return nil
+		}
+		var ev nostr.Event
+		if err := json.Unmarshal([]byte(evJSON), &ev); err != nil {
+			log.Println("[ERROR] Decoding outbox event failed:", err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events
+}
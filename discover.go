@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+)
+
+// maxDiscoveryBody limits how much of a page is read when looking for feeds.
+const maxDiscoveryBody = 5 << 20
+
+// feedLinkTypes are the MIME types of <link rel="alternate"> elements that
+// point to a feed.
+var feedLinkTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+	"application/rdf+xml":   true,
+	"application/xml":       true,
+	"text/xml":              true,
+}
+
+// commonFeedPaths are tried in this order if a page does not link any feed.
+var commonFeedPaths = []string{"/feed", "/rss", "/rss.xml", "/atom.xml", "/feed.xml", "/index.xml", "/feed.json"}
+
+// feedCandidate is a feed found on a website.
+type feedCandidate struct {
+	Url   string `json:"url"`
+	Title string `json:"title"`
+	Type  string `json:"type"`
+}
+
+// feedCandidatesError is returned when a website offers more than one feed
+// and the user has to pick one.
+type feedCandidatesError struct {
+	Candidates []feedCandidate
+}
+
+func (e *feedCandidatesError) Error() string {
+	return fmt.Sprintf("found %d feeds, pick one", len(e.Candidates))
+}
+
+// fetchPage downloads a url and returns the body and the url after redirects.
+func fetchPage(ctx context.Context, pageUrl string) ([]byte, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageUrl, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := feedHttpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, gofeed.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDiscoveryBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp.Request.URL, nil
+}
+
+// discoverFeed returns the feed at pageUrl. If pageUrl is a website, its
+// feed links and then the common feed paths are tried. A single feed is
+// returned directly, several are returned as feedCandidatesError.
+func discoverFeed(ctx context.Context, pageUrl string) (string, *gofeed.Feed, error) {
+	body, base, err := fetchPage(ctx, pageUrl)
+	if err != nil {
+		return "", nil, err
+	}
+	fp := gofeed.NewParser()
+	feed, feedErr := fp.Parse(bytes.NewReader(body))
+	if feedErr == nil {
+		return pageUrl, feed, nil
+	}
+
+	candidates := feedLinks(body, base)
+	if len(candidates) == 0 {
+		candidates = probeCommonFeedPaths(ctx, base)
+	}
+	switch len(candidates) {
+	case 0:
+		return "", nil, feedErr
+	case 1:
+		log.Println("[INFO] Discovered feed", candidates[0].Url, "on", pageUrl)
+		body, _, err := fetchPage(ctx, candidates[0].Url)
+		if err != nil {
+			return "", nil, err
+		}
+		feed, err := fp.Parse(bytes.NewReader(body))
+		return candidates[0].Url, feed, err
+	}
+	return "", nil, &feedCandidatesError{Candidates: candidates}
+}
+
+// feedLinks returns the feeds announced by <link rel="alternate"> elements.
+func feedLinks(body []byte, base *url.URL) []feedCandidate {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	candidates := []feedCandidate{}
+	seen := map[string]bool{}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "link" {
+			rel := strings.Fields(strings.ToLower(mdAttr(n, "rel")))
+			linkType := strings.ToLower(strings.TrimSpace(mdAttr(n, "type")))
+			if slices.Contains(rel, "alternate") && feedLinkTypes[linkType] {
+				if ref, err := base.Parse(strings.TrimSpace(mdAttr(n, "href"))); err == nil && !seen[ref.String()] {
+					seen[ref.String()] = true
+					candidates = append(candidates, feedCandidate{
+						Url:   ref.String(),
+						Title: strings.TrimSpace(mdAttr(n, "title")),
+						Type:  linkType,
+					})
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return candidates
+}
+
+// probeCommonFeedPaths returns the first common feed path of a site that
+// serves a valid feed.
+func probeCommonFeedPaths(ctx context.Context, base *url.URL) []feedCandidate {
+	fp := gofeed.NewParser()
+	for _, path := range commonFeedPaths {
+		ref := &url.URL{Scheme: base.Scheme, Host: base.Host, Path: path}
+		body, _, err := fetchPage(ctx, ref.String())
+		var limited *rateLimitedError
+		if errors.As(err, &limited) {
+			return nil
+		} else if err != nil {
+			continue
+		}
+		feed, err := fp.Parse(bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		return []feedCandidate{{Url: ref.String(), Title: feed.Title, Type: feed.FeedType}}
+	}
+	return nil
+}
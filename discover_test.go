@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestFeedLinks(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/post")
+	tests := []struct {
+		name string
+		html string
+		want []feedCandidate
+	}{
+		{
+			name: "rss and atom",
+			html: `<html><head>
+				<link rel="alternate" type="application/rss+xml" title="RSS" href="/feed.xml">
+				<link rel="alternate" type="application/atom+xml" title=" Atom " href="https://feeds.example.com/atom">
+			</head></html>`,
+			want: []feedCandidate{
+				{Url: "https://example.com/feed.xml", Title: "RSS", Type: "application/rss+xml"},
+				{Url: "https://feeds.example.com/atom", Title: "Atom", Type: "application/atom+xml"},
+			},
+		},
+		{
+			name: "relative to the page",
+			html: `<link rel="alternate" type="application/feed+json" href="feed.json">`,
+			want: []feedCandidate{{Url: "https://example.com/blog/feed.json", Type: "application/feed+json"}},
+		},
+		{
+			name: "case and multiple rel values",
+			html: `<link rel="Alternate Home" type="Application/RSS+XML" href="/rss">`,
+			want: []feedCandidate{{Url: "https://example.com/rss", Type: "application/rss+xml"}},
+		},
+		{
+			name: "duplicates skipped",
+			html: `<link rel="alternate" type="application/rss+xml" href="/rss"><link rel="alternate" type="application/rss+xml" href="https://example.com/rss">`,
+			want: []feedCandidate{{Url: "https://example.com/rss", Type: "application/rss+xml"}},
+		},
+		{
+			name: "other links ignored",
+			html: `<link rel="stylesheet" type="text/css" href="/style.css">
+				<link rel="alternate" type="text/html" hreflang="de" href="/de/">
+				<link rel="feed" type="application/rss+xml" href="/rss">`,
+			want: []feedCandidate{},
+		},
+		{
+			name: "no links",
+			html: `<html><body><p>nothing here</p></body></html>`,
+			want: []feedCandidate{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := feedLinks([]byte(tt.html), base); !slices.Equal(got, tt.want) {
+				t.Errorf("feedLinks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxExecOutput limits what is kept of the stdout and stderr of an exec hook.
+const maxExecOutput = 1 << 20
+
+var errExecOutputTooLarge = errors.New("output is larger than 1 MiB")
+
+// ExecHook runs a local command to enrich a Nostr event. It writes the same
+// JSON as RestEnrichHook to stdin and reads a restHookResponse from stdout.
+// How many commands run at once and the timeout come from the hook policy.
+type ExecHook struct {
+	command string
+	args    []string
+	env     []string
+}
+
+// NewExecHook creates an exec hook. env lists variables passed to the
+// command, NAME takes the value from the environment of atomstr and
+// NAME=value sets it. PATH is always passed.
+func NewExecHook(command string, args, env []string) *ExecHook {
+	cmdEnv := []string{"PATH=" + os.Getenv("PATH")}
+	for _, entry := range env {
+		if strings.Contains(entry, "=") {
+			cmdEnv = append(cmdEnv, entry)
+		} else if value, ok := os.LookupEnv(entry); ok {
+			cmdEnv = append(cmdEnv, entry+"="+value)
+		}
+	}
+	return &ExecHook{
+		command: command,
+		args:    args,
+		env:     cmdEnv,
+	}
+}
+
+func (h *ExecHook) BeforePublish(ctx context.Context, feed feedStruct, feedPost feedPostStruct, event *nostr.Event) (*nostr.Event, error) {
+	return h.run(ctx, restHookRequest{Feed: feed, FeedPost: &feedPost, NostrEvent: *event}, event)
+}
+
+func (h *ExecHook) BeforeProfilePublish(ctx context.Context, feed feedStruct, event *nostr.Event) (*nostr.Event, error) {
+	return h.run(ctx, restHookRequest{Feed: feed, NostrEvent: *event}, event)
+}
+
+func (h *ExecHook) run(ctx context.Context, payload restHookRequest, event *nostr.Event) (*nostr.Event, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, h.command, h.args...)
+	cmd.Env = h.env
+	cmd.Stdin = bytes.NewReader(body)
+	stdout := &cappedBuffer{limit: maxExecOutput}
+	stderr := &cappedBuffer{limit: maxExecOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	killProcessGroup(cmd)
+	// don't wait for children that keep the pipes open after a kill
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("exec hook %s: %w", h.command, ctx.Err())
+		}
+		msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		return nil, fmt.Errorf("exec hook %s: %v: %s", h.command, err, msg)
+	}
+	if stdout.truncated {
+		return nil, fmt.Errorf("exec hook %s: %w", h.command, errExecOutputTooLarge)
+	}
+	return decodeHookResponse(&stdout.buf, event, "exec")
+}
+
+// cappedBuffer keeps the first limit bytes written to it and discards the
+// rest, so the command doesn't block on a full pipe.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.truncated = true
+		b.buf.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
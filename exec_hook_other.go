@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroup leaves the default of exec.CommandContext: on timeout
+// only the command itself is killed, its children may keep running.
+func killProcessGroup(cmd *exec.Cmd) {}
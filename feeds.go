@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html"
 	"log"
 	"net/url"
 	"regexp"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/microcosm-cc/bluemonday"
@@ -16,79 +17,225 @@ import (
 	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
+var errFeedExists = errors.New("feed already exists")
+var errFeedNotFound = errors.New("feed not found")
+
+// postOutcome is what processFeedPost did with a post.
+type postOutcome int
+
+const (
+	postPublished postOutcome = iota
+	postSkipped
+	postFailed
+	postDeferred // a hook asked to retry it later
+)
+
+// feedColumns is the column list matching scanFeed.
+const feedColumns = `pub, sec, url, relays, tags, mode, dedupe, interval, post_interval, next_fetch_at, state, error_count, last_error, failing_since, last_success_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanFeed(row rowScanner) (feedStruct, error) {
+	feedItem := feedStruct{}
+	var relays, tags string
+	err := row.Scan(&feedItem.Pub, &feedItem.Sec, &feedItem.Url, &relays, &tags, &feedItem.Mode, &feedItem.Dedupe, &feedItem.Interval, &feedItem.PostInterval, &feedItem.NextFetch, &feedItem.State, &feedItem.ErrorCount, &feedItem.LastError, &feedItem.FailingSince, &feedItem.LastSuccess)
+	if err != nil {
+		return feedItem, err
+	}
+	feedItem.Relays = parseRelayList(relays)
+	feedItem.Tags = parseTagList(tags)
+	feedItem.Npub, _ = nip19.EncodePublicKey(feedItem.Pub)
+	return feedItem, nil
+}
+
 func (a *Atomstr) dbGetAllFeeds() *[]feedStruct {
-	sqlStatement := `SELECT pub, sec, url FROM feeds`
-	rows, err := a.db.Query(sqlStatement)
+	return a.dbQueryFeeds(`SELECT ` + feedColumns + ` FROM feeds`)
+}
+
+// dbGetActiveFeeds returns the feeds that are fetched, leaving out disabled ones.
+func (a *Atomstr) dbGetActiveFeeds() *[]feedStruct {
+	return a.dbQueryFeeds(`SELECT `+feedColumns+` FROM feeds WHERE state=?`, feedActive)
+}
+
+func (a *Atomstr) dbQueryFeeds(sqlStatement string, args ...any) *[]feedStruct {
+	rows, err := a.db.Query(sqlStatement, args...)
 	if err != nil {
 		log.Fatal("[ERROR] Returning feeds from DB failed")
 	}
+	defer rows.Close()
 
 	feedItems := []feedStruct{}
 
 	for rows.Next() {
-		feedItem := feedStruct{}
-		if err := rows.Scan(&feedItem.Pub, &feedItem.Sec, &feedItem.Url); err != nil {
+		feedItem, err := scanFeed(rows)
+		if err != nil {
 			log.Fatal("[ERROR] Scanning for feeds failed")
 		}
-		feedItem.Npub, _ = nip19.EncodePublicKey(feedItem.Pub)
 		feedItems = append(feedItems, feedItem)
 	}
 
 	return &feedItems
 }
 
-// func processFeedUrl(ch chan string, wg *sync.WaitGroup, feedItem *feedStruct) {
-func (a *Atomstr) processFeedUrl(ch chan feedStruct, wg *sync.WaitGroup) {
-	for feedItem := range ch {
-		func() {
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second) // fetch feeds with 10s timeout
-			defer cancel()
-			fp := gofeed.NewParser()
-			feed, err := fp.ParseURLWithContext(feedItem.Url, ctx)
-			if err != nil {
-				log.Println("[ERROR] Can't update feed", feedItem.Url)
-			} else {
-				log.Println("[DEBUG] Updating feed ", feedItem.Url)
-				//fmt.Println(feed)
-				feedItem.Title = feed.Title
-				feedItem.Description = feed.Description
-				feedItem.Link = feed.Link
-				if feed.Image != nil {
-					feedItem.Image = feed.Image.URL
-				} else {
-					feedItem.Image = defaultFeedImage
-				}
-				//feedItem.Image = feed.Image
-
-				for i := range feed.Items {
-					a.processFeedPost(feedItem, feed.Items[i])
-				}
-				log.Println("[DEBUG] Finished updating feed ", feedItem.Url)
+// processFeedUrl fetches a feed and publishes its new posts.
+func (a *Atomstr) processFeedUrl(ctx context.Context, feedItem feedStruct) error {
+	hostCtx, release, err := acquireHostSlot(ctx, feedItem.Url)
+	if err != nil {
+		return err
+	}
+	fetchCtx, cancel := context.WithTimeout(hostCtx, 10*time.Second) // fetch feeds with 10s timeout
+	feed, cache, err := a.fetchFeed(fetchCtx, feedItem.Url, "scrape")
+	cancel()
+	release()
+	if errors.Is(err, errFeedNotModified) {
+		log.Println("[DEBUG] Feed not modified", feedItem.Url)
+		return nil
+	} else if err != nil {
+		log.Println("[ERROR] Can't update feed", feedItem.Url)
+		return err
+	}
+
+	log.Println("[DEBUG] Updating feed ", feedItem.Url)
+	//fmt.Println(feed)
+	feedItem.Title = feed.Title
+	feedItem.Description = feed.Description
+	feedItem.Link = feed.Link
+	if feed.Image != nil {
+		feedItem.Image = feed.Image.URL
+	} else {
+		feedItem.Image = defaultFeedImage
+	}
+	//feedItem.Image = feed.Image
+
+	failed := 0
+	ids := newPostIdentities(feedItem.Url, feed.Items)
+	for i := range feed.Items {
+		if ctx.Err() != nil {
+			// don't store the cache, the rest is picked up next time
+			log.Println("[DEBUG] Interrupted updating feed", feedItem.Url)
+			return ctx.Err()
+		}
+		if a.processFeedPost(ctx, feedItem, feed.Items[i], ids[i]) == postFailed {
+			failed++
+		}
+	}
+	if failed == 0 {
+		a.dbWriteFeedCache(cache)
+	} else {
+		// without the cache the next fetch sees the feed again and retries them
+		log.Printf("[WARN] %d posts of %s failed, they are retried with the next fetch\n", failed, feedItem.Url)
+	}
+	if feedItem.Interval == feedIntervalAdaptive {
+		a.learnPostInterval(feedItem, feed.Items)
+	}
+	log.Println("[DEBUG] Finished updating feed ", feedItem.Url)
+	return nil
+}
+
+// processFeedPost processes a single feed post item. It checks if the post should be published
+// (based on age, duplicates, etc.) and publishes it with publishFeedPost.
+func (a *Atomstr) processFeedPost(ctx context.Context, feedItem feedStruct, feedPost *gofeed.Item, id postIdentity) postOutcome {
+	// Check if we should publish this post (age, duplicates, etc.)
+	shouldPublish, reason := a.shouldPublishPost(feedItem, feedPost, id)
+	if !shouldPublish {
+		log.Println("[DEBUG] Skipping post from", feedItem.Url+":", reason)
+		return postSkipped
+	}
+	return a.publishFeedPost(ctx, feedItem, feedPost, id)
+}
+
+// publishFeedPost builds, hooks, signs and publishes a post that passed the
+// checks. Posts deferred by a hook are stored and retried later.
+func (a *Atomstr) publishFeedPost(ctx context.Context, feedItem feedStruct, feedPost *gofeed.Item, id postIdentity) postOutcome {
+	var ev nostr.Event
+	if feedItem.isLongform() {
+		ev = nostrArticleEvent(feedItem, feedPost)
+	} else {
+		ev = nostrNoteEvent(feedItem, feedPost)
+	}
+
+	// Map gofeed.Item into stable feedPostStruct for hook API
+	post := feedPostStruct{
+		Title:         feedPost.Title,
+		Description:   feedPost.Description,
+		Link:          feedPost.Link,
+		GUID:          feedPost.GUID,
+		Published:     "",
+		PublishedUnix: 0,
+		Categories:    nil,
+		Enclosures:    nil,
+	}
+	if feedPost.PublishedParsed != nil {
+		post.Published = feedPost.Published
+		post.PublishedUnix = feedPost.PublishedParsed.Unix()
+	}
+	if len(feedPost.Categories) > 0 {
+		post.Categories = append(post.Categories, feedPost.Categories...)
+	}
+	if len(feedPost.Enclosures) > 0 {
+		for _, e := range feedPost.Enclosures {
+			post.Enclosures = append(post.Enclosures, e.URL)
+		}
+	}
+
+	// Run pre-publish hooks (enrichment) before signing/publishing
+	if updated, err := a.runPrePublishHooks(ctx, feedItem, post, &ev); errors.Is(err, errPostDeferred) {
+		log.Println("[WARN] Deferring post", feedPost.Link+":", err)
+		a.dbDeferPost(feedItem.Url, feedPost, id, err)
+		return postDeferred
+	} else if err != nil {
+		log.Println("[ERROR] pre-publish hooks aborted event:", err)
+		return postFailed
+	} else if updated != nil {
+		ev = *updated
+	}
+
+	// Sign after hooks potentially modify the event
+	ev.Sign(feedItem.Sec)
+
+	if !noPub {
+		// failed relays are retried from the outbox, so the post counts as published
+		results, queued := a.nostrPublishDurableResults(ctx, ev, feedItem.Url, feedItem.publishRelays())
+		publishedCount := 0
+		for _, result := range results {
+			if result.Ok {
+				publishedCount++
 			}
-		}()
+		}
+		log.Printf("[DEBUG] Published post to %d / %d relays\n", publishedCount, len(results))
+		if !queued && publishedCount == 0 {
+			// nothing retries it, leave it unrecorded for the next scrape
+			log.Println("[WARN] Post", feedPost.Link, "reached no relay and could not be queued")
+			return postFailed
+		}
+		if publishedCount > 0 {
+			a.runPostPublishHooks(ctx, feedItem, post, ev, results)
+		}
+	} else {
+		log.Println("[DEBUG] not publishing post", ev)
 	}
-	wg.Done()
+
+	log.Println("[DEBUG] Recording published post", feedPost.Link)
+	a.dbRecordPublishedPost(id, ev)
+
+	if feedItem.Mode == feedModeLongformTeaser {
+		if teaserId := a.publishArticleTeaser(ctx, feedItem, feedPost, ev); teaserId != "" {
+			a.dbSetTeaserEventId(ev.ID, teaserId)
+		}
+	}
+	return postPublished
 }
 
-// processFeedPost processes a single feed post item. It sanitizes and formats the post content,
-// checks if the post should be published (based on age, duplicates, etc.), and prepares the post
-// text and tags for publishing to Nostr. It also handles inline images, links, enclosures, and
-// categories as tags.
-func (a *Atomstr) processFeedPost(feedItem feedStruct, feedPost *gofeed.Item) {
+// nostrNoteEvent builds a kind 1 text note from a feed post. It sanitizes and formats the post
+// content and handles inline images, links, enclosures, and categories as tags.
+func nostrNoteEvent(feedItem feedStruct, feedPost *gofeed.Item) nostr.Event {
 	p := bluemonday.StrictPolicy() // initialize html sanitizer
 	p.AllowImages()
 	p.AllowStandardURLs()
 	p.AllowAttrs("href").OnElements("a")
 
-	//fmt.Println(feedPost.PublishedParsed)
-
-	// Check if we should publish this post (age, duplicates, etc.)
-	shouldPublish, reason := a.shouldPublishPost(feedItem, feedPost)
-	if !shouldPublish {
-		log.Println("[DEBUG] Skipping post from", feedItem.Url+":", reason)
-		return
-	}
-
 	var feedText string
 	var re = regexp.MustCompile(`nitter|telegram`)
 	if re.MatchString(feedPost.Link) { // fix duplicated title in nitter/telegram
@@ -126,71 +273,17 @@ func (a *Atomstr) processFeedPost(feedItem feedStruct, feedPost *gofeed.Item) {
 
 	tags = append(tags, nostr.Tag{"proxy", feedItem.Url + `#` + url.QueryEscape(feedPost.Link), "rss"})
 
-	ev := nostr.Event{
+	return nostr.Event{
 		PubKey:    feedItem.Pub,
 		CreatedAt: nostr.Timestamp(feedPost.PublishedParsed.Unix()),
 		Kind:      nostr.KindTextNote,
 		Tags:      tags,
 		Content:   feedText,
 	}
-
-	// Map gofeed.Item into stable feedPostStruct for hook API
-	post := feedPostStruct{
-		Title:         feedPost.Title,
-		Description:   feedPost.Description,
-		Link:          feedPost.Link,
-		GUID:          feedPost.GUID,
-		Published:     "",
-		PublishedUnix: 0,
-		Categories:    nil,
-		Enclosures:    nil,
-	}
-	if feedPost.PublishedParsed != nil {
-		post.Published = feedPost.Published
-		post.PublishedUnix = feedPost.PublishedParsed.Unix()
-	}
-	if len(feedPost.Categories) > 0 {
-		post.Categories = append(post.Categories, feedPost.Categories...)
-	}
-	if len(feedPost.Enclosures) > 0 {
-		for _, e := range feedPost.Enclosures {
-			post.Enclosures = append(post.Enclosures, e.URL)
-		}
-	}
-
-	// Run pre-publish hooks (enrichment) before signing/publishing
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if updated, err := a.runPrePublishHooks(ctx, feedItem, post, &ev); err != nil {
-		log.Println("[ERROR] pre-publish hooks aborted event:", err)
-		return
-	} else if updated != nil {
-		ev = *updated
-	}
-
-	// Sign after hooks potentially modify the event
-	ev.Sign(feedItem.Sec)
-
-	var shouldRecord = true
-
-	if !noPub {
-		publishedCount, errCount := nostrPostItem(ev)
-		log.Printf("[DEBUG] Published post to %d / %d relays\n", publishedCount, errCount+publishedCount)
-		shouldRecord = publishedCount > 0
-	} else {
-		log.Println("[DEBUG] not publishing post", ev)
-		shouldRecord = true
-	}
-
-	if shouldRecord {
-		log.Println("[DEBUG] Recording published post", feedPost.Link)
-		a.dbRecordPublishedPost(feedPost.Link, feedItem.Url, ev.ID)
-	}
-
 }
 
 func (a *Atomstr) dbWriteFeed(feedItem *feedStruct) bool {
-	_, err := a.db.Exec(`insert into feeds (pub, sec, url) values(?, ?, ?)`, feedItem.Pub, feedItem.Sec, feedItem.Url)
+	_, err := a.db.Exec(`insert into feeds (pub, sec, url, relays, tags, mode, dedupe, interval, next_fetch_at) values(?, ?, ?, ?, ?, ?, ?, ?, ?)`, feedItem.Pub, feedItem.Sec, feedItem.Url, strings.Join(feedItem.Relays, ","), strings.Join(feedItem.Tags, ","), feedItem.Mode, feedItem.Dedupe, feedItem.Interval, feedItem.NextFetch)
 	if err != nil {
 		log.Println("[ERROR] Can't add feed!")
 		log.Fatal(err)
@@ -201,42 +294,123 @@ func (a *Atomstr) dbWriteFeed(feedItem *feedStruct) bool {
 }
 
 func (a *Atomstr) dbGetFeed(feedUrl string) *feedStruct {
-	sqlStatement := `SELECT pub, sec, url FROM feeds WHERE url=$1;`
+	sqlStatement := `SELECT ` + feedColumns + ` FROM feeds WHERE url=$1;`
 	row := a.db.QueryRow(sqlStatement, feedUrl)
 
-	feedItem := feedStruct{}
-	err := row.Scan(&feedItem.Pub, &feedItem.Sec, &feedItem.Url)
-
+	feedItem, err := scanFeed(row)
 	if err != nil {
 		log.Println("[INFO] Feed not found in DB")
+		return &feedStruct{}
 	}
 	return &feedItem
 }
 
-func (a *Atomstr) dbCheckPublishedPost(postUrl string) bool {
-	sqlStatement := `SELECT COUNT(*) FROM published_posts WHERE url=?;`
-	row := a.db.QueryRow(sqlStatement, postUrl)
+func (a *Atomstr) dbGetFeedByPub(pub string) *feedStruct {
+	sqlStatement := `SELECT ` + feedColumns + ` FROM feeds WHERE pub=?;`
+	row := a.db.QueryRow(sqlStatement, pub)
 
-	var count int
-	err := row.Scan(&count)
+	feedItem, err := scanFeed(row)
 	if err != nil {
-		log.Println("[ERROR] Failed to check published post:", err)
+		log.Println("[INFO] Feed not found in DB")
+		return &feedStruct{}
+	}
+	return &feedItem
+}
+
+// dbUpdateFeedSettings stores all settings that are set in settings.
+func (a *Atomstr) dbUpdateFeedSettings(feedUrl string, settings feedSettings) bool {
+	var sets []string
+	var args []any
+	if settings.Relays != nil {
+		sets = append(sets, "relays=?")
+		args = append(args, strings.Join(*settings.Relays, ","))
+	}
+	if settings.Tags != nil {
+		sets = append(sets, "tags=?")
+		args = append(args, strings.Join(*settings.Tags, ","))
+	}
+	if settings.Mode != nil {
+		sets = append(sets, "mode=?")
+		args = append(args, *settings.Mode)
+	}
+	if settings.Dedupe != nil {
+		sets = append(sets, "dedupe=?")
+		args = append(args, *settings.Dedupe)
+	}
+	if settings.Interval != nil {
+		// reschedule on the next pass of the scrape loop
+		sets = append(sets, "interval=?", "next_fetch_at=0")
+		args = append(args, *settings.Interval)
+	}
+	if len(sets) == 0 {
+		return true
+	}
+	args = append(args, feedUrl)
+	_, err := a.db.Exec(`UPDATE feeds SET `+strings.Join(sets, ", ")+` WHERE url=?;`, args...)
+	if err != nil {
+		log.Println("[ERROR] Can't update feed settings:", err)
 		return false
 	}
-	return count > 0
+	return true
 }
 
-func (a *Atomstr) dbRecordPublishedPost(postUrl, feedUrl, nostrEventId string) bool {
-	sqlStatement := `INSERT INTO published_posts (url, feed_url, published_at, nostr_event_id) VALUES (?, ?, ?, ?);`
-	_, err := a.db.Exec(sqlStatement, postUrl, feedUrl, time.Now().Unix(), nostrEventId)
+// applySettings copies all set fields of settings into the feed.
+func (feedItem *feedStruct) applySettings(settings feedSettings) {
+	if settings.Relays != nil {
+		feedItem.Relays = *settings.Relays
+	}
+	if settings.Tags != nil {
+		feedItem.Tags = *settings.Tags
+	}
+	if settings.Mode != nil {
+		feedItem.Mode = *settings.Mode
+	}
+	if settings.Dedupe != nil {
+		feedItem.Dedupe = *settings.Dedupe
+	}
+	if settings.Interval != nil {
+		feedItem.Interval = *settings.Interval
+	}
+}
+
+// isLongform reports whether the feed publishes NIP-23 articles.
+func (feedItem *feedStruct) isLongform() bool {
+	return feedItem.Mode == feedModeLongform || feedItem.Mode == feedModeLongformTeaser
+}
+
+// publishRelays returns the relays a feed publishes to, falling back to the
+// global RELAYS_TO_PUBLISH_TO list.
+func (feedItem *feedStruct) publishRelays() []string {
+	if len(feedItem.Relays) > 0 {
+		return feedItem.Relays
+	}
+	return relaysToPublishTo
+}
+
+// dbRecordPublishedPost records a post with its event. For articles the d
+// identifier is kept to address them in deletions.
+func (a *Atomstr) dbRecordPublishedPost(id postIdentity, ev nostr.Event) bool {
+	articleD := ""
+	if ev.Kind == nostr.KindArticle {
+		articleD = ev.Tags.GetD()
+	}
+	sqlStatement := `INSERT INTO published_posts (url, feed_url, guid, normalized_url, content_hash, published_at, nostr_event_id, article_d) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err := a.db.Exec(sqlStatement, id.Link, id.FeedUrl, id.GUID, id.NormalizedLink, id.ContentHash, time.Now().Unix(), ev.ID, articleD)
 	if err != nil {
 		log.Println("[ERROR] Failed to record published post:", err)
 		return false
 	}
-	log.Println("[DEBUG] Recorded published post:", postUrl, "with event ID:", nostrEventId)
+	log.Println("[DEBUG] Recorded published post:", id.Link, "with event ID:", ev.ID)
 	return true
 }
 
+func (a *Atomstr) dbSetTeaserEventId(nostrEventId, teaserEventId string) {
+	_, err := a.db.Exec(`UPDATE published_posts SET teaser_event_id=? WHERE nostr_event_id=?;`, teaserEventId, nostrEventId)
+	if err != nil {
+		log.Println("[ERROR] Failed to record teaser:", err)
+	}
+}
+
 func (a *Atomstr) dbGetPublishedPostByEventId(nostrEventId string) (string, bool) {
 	sqlStatement := `SELECT url FROM published_posts WHERE nostr_event_id=?;`
 	row := a.db.QueryRow(sqlStatement, nostrEventId)
@@ -268,7 +442,7 @@ func (a *Atomstr) dbPrunePublishedPosts(olderThan time.Duration) (int64, error)
 	return rowsAffected, nil
 }
 
-func (a *Atomstr) shouldPublishPost(feedItem feedStruct, feedPost *gofeed.Item) (bool, string) {
+func (a *Atomstr) shouldPublishPost(feedItem feedStruct, feedPost *gofeed.Item, id postIdentity) (bool, string) {
 	// Check if post has a valid timestamp
 	if feedPost.PublishedParsed == nil {
 		return false, "Can't read PublishedParsed date"
@@ -281,26 +455,31 @@ func (a *Atomstr) shouldPublishPost(feedItem feedStruct, feedPost *gofeed.Item)
 	}
 
 	// Check if already published
-	if a.dbCheckPublishedPost(feedPost.Link) {
+	if a.dbCheckPublishedPost(id, feedItem.Dedupe) {
 		return false, "Post already published"
 	}
 
 	return true, "Ready to publish"
 }
 
-func checkValidFeedSource(feedUrl string) (*feedStruct, error) {
+func checkValidFeedSource(ctx context.Context, feedUrl string) (*feedStruct, error) {
 	log.Println("[DEBUG] Trying to find feed at", feedUrl)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	fp := gofeed.NewParser()
-	feed, err := fp.ParseURLWithContext(feedUrl, ctx)
-	feedItem := feedStruct{}
-
-	if err != nil {
+	feedUrl, feed, err := discoverFeed(ctx, feedUrl)
+	var candidates *feedCandidatesError
+	if errors.As(err, &candidates) {
+		return &feedStruct{}, err
+	} else if err != nil {
 		log.Println("[ERROR] Not a valid feed source")
-		return &feedItem, err
+		return &feedStruct{}, err
 	}
-	// FIXME! That needs proper error handling.
+	return feedStructFromFeed(feedUrl, feed), nil
+}
+
+// feedStructFromFeed copies the feed level fields of a parsed feed into a feedStruct.
+func feedStructFromFeed(feedUrl string, feed *gofeed.Feed) *feedStruct {
+	feedItem := feedStruct{}
 	feedItem.Url = feedUrl
 	feedItem.Title = feed.Title
 	feedItem.Description = feed.Description
@@ -312,59 +491,165 @@ func checkValidFeedSource(feedUrl string) (*feedStruct, error) {
 	}
 	feedItem.Posts = feed.Items
 
-	return &feedItem, err
+	return &feedItem
+}
+
+// addSource adds a feed and publishes its history before returning.
+func (a *Atomstr) addSource(ctx context.Context, feedUrl string, settings feedSettings) (*feedStruct, error) {
+	feedItem, err := a.createSource(ctx, feedUrl, settings)
+	if err != nil {
+		return feedItem, err
+	}
+	// a scrape or metadata run may pick up the new feed right away
+	if !a.sched.lockFeed(ctx, feedItem.Url) {
+		return feedItem, ctx.Err()
+	}
+	defer a.sched.unlockFeed(feedItem.Url)
+	return feedItem, a.publishSourceHistory(ctx, feedItem, nil)
 }
 
-func (a *Atomstr) addSource(feedUrl string) (*feedStruct, error) {
+// createSource validates a feed, generates its keys and stores it.
+func (a *Atomstr) createSource(ctx context.Context, feedUrl string, settings feedSettings) (*feedStruct, error) {
+	// check for existing feed before fetching it
+	if feedTest := a.dbGetFeed(feedUrl); feedTest.Url != "" {
+		log.Println("[WARN] Feed already exists")
+		return feedTest, errFeedExists
+	}
+
 	//var feedElem2 *feedStruct
-	feedItem, err := checkValidFeedSource(feedUrl)
+	feedItem, err := checkValidFeedSource(ctx, feedUrl)
 	//if feedItem.Title == "" {
-	if err != nil {
+	var candidates *feedCandidatesError
+	if errors.As(err, &candidates) {
+		log.Println("[WARN] Found several feeds on", feedUrl+", pick one:")
+		for _, candidate := range candidates.Candidates {
+			log.Println("[WARN]  ", candidate.Url, candidate.Title)
+		}
+		return feedItem, err
+	} else if err != nil {
 		log.Println("[ERROR] No valid feed found on", feedUrl)
 		return feedItem, err
 	}
+	feedUrl = feedItem.Url // the page may have pointed to its feed
 
-	// check for existing feed
+	// the feed discovered on a page may exist already
 	feedTest := a.dbGetFeed(feedUrl)
 	if feedTest.Url != "" {
 		log.Println("[WARN] Feed already exists")
-		return feedItem, err
+		return feedItem, errFeedExists
 	}
 
-	feedItemKeys := generateKeysForUrl(feedUrl)
+	feedItemKeys, err := a.feedKeys(feedUrl, settings.Sec)
+	if err != nil {
+		log.Println("[ERROR] Can't use key:", err)
+		return feedItem, err
+	}
 	feedItem.Pub = feedItemKeys.Pub
 	feedItem.Sec = feedItemKeys.Sec
+	feedItem.Relays = []string{}
+	feedItem.Tags = []string{}
+	feedItem.Mode = feedModeNote
+	feedItem.Dedupe = dedupeAuto
+	feedItem.State = feedActive
+	feedItem.applySettings(settings)
+	// the history is published right away, fetch again after one interval
+	feedItem.NextFetch = time.Now().Add(withJitter(feedItem.fetchInterval())).Unix()
 	//fmt.Println(feedItem)
 
 	a.dbWriteFeed(feedItem)
+	a.dbDeleteArchivedKey(feedUrl)
+	return feedItem, nil
+}
+
+// publishSourceHistory announces a new feed and publishes its current posts.
+// progress, if set, is called with the outcome of every post. It stops early
+// if ctx is cancelled.
+func (a *Atomstr) publishSourceHistory(ctx context.Context, feedItem *feedStruct, progress func(postOutcome)) error {
 	if !noPub {
-		nostrUpdateFeedMetadata(feedItem)
+		a.nostrUpdateFeedMetadata(ctx, feedItem)
 	}
 
 	log.Println("[INFO] Parsing post history of new feed")
+	ids := newPostIdentities(feedItem.Url, feedItem.Posts)
 	for i := range feedItem.Posts {
-		a.processFeedPost(*feedItem, feedItem.Posts[i])
+		if ctx.Err() != nil {
+			log.Println("[WARN] Interrupted parsing post history of", feedItem.Url)
+			return ctx.Err()
+		}
+		outcome := a.processFeedPost(ctx, *feedItem, feedItem.Posts[i], ids[i])
+		if progress != nil {
+			progress(outcome)
+		}
 	}
 	log.Println("[INFO] Finished parsing post history of new feed")
-
-	return feedItem, err
+	return nil
 }
-func (a *Atomstr) deleteSource(feedUrl string) bool {
+
+// deleteSource removes a feed. With purge, deletions of everything it
+// published and a blank profile are published first.
+func (a *Atomstr) deleteSource(ctx context.Context, feedUrl string, purge bool) error {
 	// check for existing feed
 	feedTest := a.dbGetFeed(feedUrl)
-	if feedTest.Url != "" {
-		sqlStatement := `DELETE FROM feeds WHERE url=$1;`
-		_, err := a.db.Exec(sqlStatement, feedUrl)
-		if err != nil {
-			log.Println("[WARN] Can't remove feed")
-			log.Fatal(err)
+	if feedTest.Url == "" {
+		log.Println("[WARN] feed not found")
+		return errFeedNotFound
+	}
+	// don't publish posts of the feed while it is purged and removed
+	if !a.sched.lockFeed(ctx, feedUrl) {
+		return ctx.Err()
+	}
+	defer a.sched.unlockFeed(feedUrl)
+	if purge {
+		a.purgeFeed(ctx, feedTest)
+		if ctx.Err() != nil {
+			// keep the feed and its key, the purge has to be done again
+			return ctx.Err()
 		}
-		log.Println("[INFO] feed removed")
-		return true
+	}
+	sqlStatement := `DELETE FROM feeds WHERE url=$1;`
+	_, err := a.db.Exec(sqlStatement, feedUrl)
+	if err != nil {
+		log.Println("[ERROR] Can't remove feed:", err)
+		return err
+	}
+	// a purged feed is gone for good, don't restore its blank profile
+	if purge {
+		a.dbDeleteArchivedKey(feedUrl)
 	} else {
+		a.dbArchiveKey(feedTest)
+	}
+	a.dbDeleteDeferredPosts(feedUrl)
+	a.dbDeleteFeedCache(feedUrl)
+	log.Println("[INFO] feed removed")
+	return nil
+}
+
+// updateFeedSettings changes the settings of an existing feed and announces
+// them with new metadata and relay list events.
+func (a *Atomstr) updateFeedSettings(ctx context.Context, feedUrl string, settings feedSettings) (*feedStruct, error) {
+	feedItem := a.dbGetFeed(feedUrl)
+	if feedItem.Url == "" {
 		log.Println("[WARN] feed not found")
-		return false
+		return feedItem, errFeedNotFound
+	}
+	if !a.dbUpdateFeedSettings(feedUrl, settings) {
+		return feedItem, errors.New("can't update feed settings")
 	}
+	feedItem.applySettings(settings)
+	log.Println("[INFO] Updated settings of", feedUrl)
+
+	if !noPub && settings.Relays != nil {
+		data, err := checkValidFeedSource(ctx, feedUrl)
+		if err != nil {
+			return feedItem, err
+		}
+		feedItem.Title = data.Title
+		feedItem.Description = data.Description
+		feedItem.Link = data.Link
+		feedItem.Image = data.Image
+		a.nostrUpdateFeedMetadata(ctx, feedItem)
+	}
+	return feedItem, nil
 }
 
 func (a *Atomstr) listFeeds() {
@@ -373,7 +658,26 @@ func (a *Atomstr) listFeeds() {
 	for _, feedItem := range *feeds {
 		nip19Pub, _ := nip19.EncodePublicKey(feedItem.Pub)
 		fmt.Print(nip19Pub + " ")
-		fmt.Println(feedItem.Url)
+		fmt.Print(feedItem.Url)
+		fmt.Print(" " + feedItem.Mode + " " + feedItem.Dedupe)
+		if feedItem.Interval == feedIntervalAdaptive {
+			fmt.Print(" adaptive, every " + feedItem.fetchInterval().String())
+		} else if feedItem.Interval != "" {
+			fmt.Print(" every " + feedItem.Interval)
+		}
+		if feedItem.State != feedActive {
+			fmt.Print(" " + strings.ToUpper(feedItem.State))
+		}
+		if feedItem.ErrorCount > 0 {
+			fmt.Printf(" failing %dx since %s: %s", feedItem.ErrorCount, time.Unix(feedItem.FailingSince, 0).UTC().Format(time.DateTime), feedItem.LastError)
+		}
+		if len(feedItem.Relays) > 0 {
+			fmt.Print(" " + strings.Join(feedItem.Relays, ","))
+		}
+		if len(feedItem.Tags) > 0 {
+			fmt.Print(" tags:" + strings.Join(feedItem.Tags, ","))
+		}
+		fmt.Println()
 	}
 
 }
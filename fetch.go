@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// errFeedNotModified is returned by fetchFeed when the server answered 304
+// or the body is byte-identical to the last fetch.
+var errFeedNotModified = errors.New("feed not modified")
+
+// maxFeedBody is the largest feed that is downloaded.
+const maxFeedBody = 10 << 20
+
+var errFeedTooLarge = errors.New("feed is larger than 10 MiB")
+
+// feedCacheStruct holds the HTTP validators of the last successful fetch of a
+// feed. Entries are kept per work type ("scrape", "metadata") so that one run
+// does not hide changes from the other.
+type feedCacheStruct struct {
+	Url          string
+	Work         string
+	ETag         string
+	LastModified string
+	BodyHash     string
+}
+
+// feedHttpClient is used for all feed and website requests, politeTransport
+// spreads them per host.
+var feedHttpClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: &politeTransport{base: http.DefaultTransport, limiter: feedHosts},
+}
+
+// fetchFeed downloads a feed with a conditional GET using the cached ETag and
+// Last-Modified headers. It returns errFeedNotModified if nothing changed since
+// the last fetch. The returned cache entry has to be stored with
+// dbWriteFeedCache once the feed has been processed.
+func (a *Atomstr) fetchFeed(ctx context.Context, feedUrl, work string) (*gofeed.Feed, *feedCacheStruct, error) {
+	cache := a.dbGetFeedCache(feedUrl, work)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedUrl, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if cache.ETag != "" {
+		req.Header.Set("If-None-Match", cache.ETag)
+	}
+	if cache.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cache.LastModified)
+	}
+
+	resp, err := feedHttpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, cache, errFeedNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, gofeed.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedBody+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) > maxFeedBody {
+		return nil, nil, errFeedTooLarge
+	}
+	sum := sha256.Sum256(body)
+
+	newCache := &feedCacheStruct{
+		Url:          feedUrl,
+		Work:         work,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		BodyHash:     hex.EncodeToString(sum[:]),
+	}
+	if cache.BodyHash != "" && cache.BodyHash == newCache.BodyHash {
+		// server ignores conditional requests, but content is the same
+		a.dbWriteFeedCache(newCache)
+		return nil, newCache, errFeedNotModified
+	}
+
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	return feed, newCache, nil
+}
+
+func (a *Atomstr) dbGetFeedCache(feedUrl, work string) *feedCacheStruct {
+	sqlStatement := `SELECT etag, last_modified, body_hash FROM feed_cache WHERE url=? AND work=?;`
+	row := a.db.QueryRow(sqlStatement, feedUrl, work)
+
+	cache := feedCacheStruct{Url: feedUrl, Work: work}
+	err := row.Scan(&cache.ETag, &cache.LastModified, &cache.BodyHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Println("[ERROR] Failed to read feed cache:", err)
+	}
+	return &cache
+}
+
+func (a *Atomstr) dbWriteFeedCache(cache *feedCacheStruct) bool {
+	sqlStatement := `INSERT INTO feed_cache (url, work, etag, last_modified, body_hash, fetched_at) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(url, work) DO UPDATE SET etag=excluded.etag, last_modified=excluded.last_modified, body_hash=excluded.body_hash, fetched_at=excluded.fetched_at;`
+	_, err := a.db.Exec(sqlStatement, cache.Url, cache.Work, cache.ETag, cache.LastModified, cache.BodyHash, time.Now().Unix())
+	if err != nil {
+		log.Println("[ERROR] Failed to write feed cache:", err)
+		return false
+	}
+	return true
+}
+
+func (a *Atomstr) dbDeleteFeedCache(feedUrl string) {
+	_, err := a.db.Exec(`DELETE FROM feed_cache WHERE url=?;`, feedUrl)
+	if err != nil {
+		log.Println("[ERROR] Failed to delete feed cache:", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Feed states
+const (
+	feedActive   = "active"
+	feedPaused   = "paused"   // stopped by the user
+	feedDisabled = "disabled" // kept failing for FEED_DISABLE_AFTER
+)
+
+// backoffInterval is how long to wait before fetching a failing feed again.
+// The interval doubles with every failure in a row, up to FEED_BACKOFF_MAX.
+func (feedItem *feedStruct) backoffInterval() time.Duration {
+	interval := feedItem.fetchInterval()
+	if feedItem.ErrorCount == 0 || interval >= feedBackoffMax {
+		return interval
+	}
+	for i := 0; i < feedItem.ErrorCount && interval < feedBackoffMax; i++ {
+		interval *= 2
+	}
+	if interval > feedBackoffMax {
+		interval = feedBackoffMax
+	}
+	return interval
+}
+
+// recordFetchResult updates the health of a feed after it was scraped. Feeds
+// failing for longer than FEED_DISABLE_AFTER are disabled.
+func (a *Atomstr) recordFetchResult(feedUrl string, fetchErr error) {
+	now := time.Now().Unix()
+	if fetchErr == nil {
+		sqlStatement := `UPDATE feeds SET error_count=0, last_error='', failing_since=0, last_success_at=? WHERE url=?;`
+		if _, err := a.db.Exec(sqlStatement, now, feedUrl); err != nil {
+			log.Println("[ERROR] Can't update feed health:", err)
+		}
+		return
+	}
+
+	sqlStatement := `UPDATE feeds SET error_count=error_count+1, last_error=?, failing_since=CASE WHEN failing_since=0 THEN ? ELSE failing_since END WHERE url=?;`
+	if _, err := a.db.Exec(sqlStatement, fetchErr.Error(), now, feedUrl); err != nil {
+		log.Println("[ERROR] Can't update feed health:", err)
+		return
+	}
+	if feedDisableAfter <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-feedDisableAfter).Unix()
+	sqlStatement = `UPDATE feeds SET state=? WHERE url=? AND state=? AND failing_since>0 AND failing_since<?;`
+	res, err := a.db.Exec(sqlStatement, feedDisabled, feedUrl, feedActive, cutoff)
+	if err != nil {
+		log.Println("[ERROR] Can't disable feed:", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[WARN] Disabled feed %s, it failed for more than %v: %v\n", feedUrl, feedDisableAfter, fetchErr)
+	}
+}
+
+// pauseFeed stops fetching a feed. Its keys and history are kept.
+func (a *Atomstr) pauseFeed(feedUrl string) (*feedStruct, error) {
+	feedItem := a.dbGetFeed(feedUrl)
+	if feedItem.Url == "" {
+		log.Println("[WARN] feed not found")
+		return feedItem, errFeedNotFound
+	}
+	if _, err := a.db.Exec(`UPDATE feeds SET state=? WHERE url=?;`, feedPaused, feedUrl); err != nil {
+		log.Println("[ERROR] Can't pause feed:", err)
+		return feedItem, err
+	}
+	feedItem.State = feedPaused
+	log.Println("[INFO] Paused feed", feedUrl)
+	return feedItem, nil
+}
+
+// resumeFeed makes a paused or disabled feed active again and fetches it
+// soon, within the jitter of its interval.
+func (a *Atomstr) resumeFeed(feedUrl string) (*feedStruct, error) {
+	feedItem := a.dbGetFeed(feedUrl)
+	if feedItem.Url == "" {
+		log.Println("[WARN] feed not found")
+		return feedItem, errFeedNotFound
+	}
+	sqlStatement := `UPDATE feeds SET state=?, error_count=0, last_error='', failing_since=0, next_fetch_at=0 WHERE url=?;`
+	if _, err := a.db.Exec(sqlStatement, feedActive, feedUrl); err != nil {
+		log.Println("[ERROR] Can't resume feed:", err)
+		return feedItem, err
+	}
+	feedItem.State = feedActive
+	feedItem.ErrorCount, feedItem.LastError, feedItem.FailingSince, feedItem.NextFetch = 0, "", 0, 0
+	log.Println("[INFO] Resumed feed", feedUrl)
+	return feedItem, nil
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/logutils"
@@ -38,22 +41,142 @@ func checkMaxAge(itemTime *time.Time, maxAgeHours time.Duration) bool {
 	return itemTime.UTC().After(maxAge)
 }
 
-func dbInit() *sql.DB {
+func dbOpen() *sql.DB {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		log.Fatalf("[FATAL] open db: %v", err)
 	}
 	log.Printf("[INFO] database opened at %s", dbPath)
-	//defer db.Close()
+	return db
+}
 
-	_, err = db.Exec(sqlInit)
+// dbOpenReadOnly opens the database without creating or changing it.
+func dbOpenReadOnly() *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
 	if err != nil {
-		log.Printf("%q: %s\n", err, sqlInit)
+		log.Fatalf("[FATAL] open db: %v", err)
+	}
+	log.Printf("[INFO] database opened read-only at %s", dbPath)
+	return db
+}
+
+func dbInit() *sql.DB {
+	db := dbOpen()
+	//defer db.Close()
+
+	if err := dbMigrate(db); err != nil {
+		log.Fatalf("[FATAL] migrate db: %v", err)
 	}
 
 	return db
 }
 
+// parseRelayList splits a comma separated list of relay URLs.
+func parseRelayList(s string) []string {
+	relays := []string{}
+	for _, relay := range strings.Split(s, ",") {
+		relay = strings.TrimSpace(relay)
+		if relay != "" {
+			relays = append(relays, nostr.NormalizeURL(relay))
+		}
+	}
+	return relays
+}
+
+// parseTagList splits a comma separated list of feed tags. Tags are
+// lowercase, so they match regardless of case.
+func parseTagList(s string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// parseFeedMode validates a feed mode, an empty mode is the default.
+func parseFeedMode(mode string) (string, error) {
+	mode = strings.TrimSpace(mode)
+	if mode == "" {
+		return feedModeNote, nil
+	}
+	for _, m := range feedModes {
+		if m == mode {
+			return mode, nil
+		}
+	}
+	return "", errors.New("invalid feed mode: " + mode)
+}
+
+// parseDedupeStrategy validates a dedupe strategy, an empty one is the default.
+func parseDedupeStrategy(strategy string) (string, error) {
+	strategy = strings.TrimSpace(strategy)
+	if strategy == "" {
+		return dedupeAuto, nil
+	}
+	for _, s := range dedupeStrategies {
+		if s == strategy {
+			return strategy, nil
+		}
+	}
+	return "", errors.New("invalid dedupe strategy: " + strategy)
+}
+
+// parseFeedSettings builds feedSettings from raw user input. Nil inputs are
+// left unset so they keep their current or default value.
+func parseFeedSettings(relays, tags, mode, dedupe, interval *string) (feedSettings, error) {
+	settings := feedSettings{}
+	if relays != nil {
+		list := parseRelayList(*relays)
+		settings.Relays = &list
+	}
+	if tags != nil {
+		list := parseTagList(*tags)
+		settings.Tags = &list
+	}
+	if mode != nil {
+		m, err := parseFeedMode(*mode)
+		if err != nil {
+			return settings, err
+		}
+		settings.Mode = &m
+	}
+	if dedupe != nil {
+		d, err := parseDedupeStrategy(*dedupe)
+		if err != nil {
+			return settings, err
+		}
+		settings.Dedupe = &d
+	}
+	if interval != nil {
+		i, err := parseFeedInterval(*interval)
+		if err != nil {
+			return settings, err
+		}
+		settings.Interval = &i
+	}
+	return settings, nil
+}
+
+// parseFeedInterval validates a fetch interval. An empty interval or
+// "default" uses FETCH_INTERVAL.
+func parseFeedInterval(interval string) (string, error) {
+	interval = strings.TrimSpace(interval)
+	if interval == "" || interval == "default" {
+		return "", nil
+	}
+	if interval == feedIntervalAdaptive {
+		return interval, nil
+	}
+	d, err := parseDurationWithDays(interval)
+	if err != nil || d < time.Minute {
+		return "", errors.New("invalid interval: " + interval + ", use a duration of at least 1m or adaptive")
+	}
+	return interval, nil
+}
+
 func generateKeysForUrl(feedUrl string) *feedStruct {
 	feedElem := feedStruct{}
 	feedElem.Url = feedUrl
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// What a failing hook does to the post
+const (
+	hookOnErrorAbort = "abort" // drop the post
+	hookOnErrorSkip  = "skip"  // publish it without the hook
+	hookOnErrorDefer = "defer" // retry the post later
+)
+
+// hookRetryDelay is the default wait before the first retry of a hook.
+const hookRetryDelay = time.Second
+
+// errPostDeferred is returned by pre-publish hooks with onError: defer. The
+// post is stored and published again later.
+var errPostDeferred = errors.New("post deferred by hook")
+
+// errHookCircuitOpen is returned instead of calling a hook whose circuit
+// breaker is open.
+var errHookCircuitOpen = errors.New("circuit breaker open")
+
+// hookPolicy controls how a configured hook is called: a timeout per attempt,
+// retries with backoff, what a failure does and a circuit breaker that stops
+// calling a hook after too many failures in a row.
+type hookPolicy struct {
+	name            string
+	onError         string
+	retries         int
+	retryDelay      time.Duration // wait before the first retry, doubles per attempt
+	timeout         time.Duration
+	breakerFailures int // failed calls in a row that open the breaker, 0 disables it
+	breakerCooldown time.Duration
+	slots           chan struct{} // limits calls running at once, nil for no limit
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time // zero while the breaker is closed
+	probing   bool      // a half-open call is running
+}
+
+// call runs fn with retries. It fails right away while the breaker is open.
+func (p *hookPolicy) call(ctx context.Context, fn func(context.Context) error) error {
+	if !p.allow() {
+		return errHookCircuitOpen
+	}
+
+	delay := p.retryDelay
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = p.attempt(ctx, fn)
+		if err == nil || attempt >= p.retries || ctx.Err() != nil {
+			break
+		}
+		log.Printf("[DEBUG] Hook %s failed, retrying in %v: %v\n", p.name, delay, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	p.record(err)
+	return err
+}
+
+// attempt calls fn once with the timeout. Waiting for a free slot doesn't
+// count towards the timeout.
+func (p *hookPolicy) attempt(ctx context.Context, fn func(context.Context) error) error {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+			defer func() { <-p.slots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return fn(attemptCtx)
+}
+
+// allow reports whether the hook may be called. After the cooldown the
+// breaker is half-open and lets a single call through.
+func (p *hookPolicy) allow() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(p.openUntil) || p.probing {
+		return false
+	}
+	p.probing = true
+	return true
+}
+
+// record counts failed calls in a row and opens the breaker. A successful
+// call closes it, a failed half-open call opens it again.
+func (p *hookPolicy) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.probing = false
+	if err == nil {
+		p.failures = 0
+		p.openUntil = time.Time{}
+		return
+	}
+	p.failures++
+	if p.breakerFailures > 0 && p.failures >= p.breakerFailures {
+		p.openUntil = time.Now().Add(p.breakerCooldown)
+		log.Printf("[WARN] Hook %s failed %d times in a row, not calling it for %v\n", p.name, p.failures, p.breakerCooldown)
+	}
+}
+
+// failed applies onError to an error of the hook. It returns nil if the
+// hook should be skipped. While the breaker is open the hook is bypassed,
+// only with onError: defer the post waits for it.
+func (p *hookPolicy) failed(err error) error {
+	if errors.Is(err, errHookCircuitOpen) && p.onError != hookOnErrorDefer {
+		log.Printf("[DEBUG] Bypassing hook %s, its circuit breaker is open\n", p.name)
+		return nil
+	}
+	switch p.onError {
+	case hookOnErrorSkip:
+		log.Printf("[WARN] Skipping hook %s: %v\n", p.name, err)
+		return nil
+	case hookOnErrorDefer:
+		return fmt.Errorf("%w: %s: %v", errPostDeferred, p.name, err)
+	}
+	return fmt.Errorf("hook %s: %w", p.name, err)
+}
+
+// guardedEventHook calls a pre-publish hook with its policy.
+type guardedEventHook struct {
+	hookScope
+	policy *hookPolicy
+	hook   NostrEventHook
+}
+
+func (h *guardedEventHook) BeforePublish(ctx context.Context, feed feedStruct, feedPost feedPostStruct, event *nostr.Event) (*nostr.Event, error) {
+	var updated *nostr.Event
+	err := h.policy.call(ctx, func(ctx context.Context) error {
+		var err error
+		updated, err = h.hook.BeforePublish(ctx, feed, feedPost, event)
+		return err
+	})
+	if err != nil {
+		if err = h.policy.failed(err); err != nil {
+			return nil, err
+		}
+		return event, nil
+	}
+	return updated, nil
+}
+
+// guardedProfileHook calls a profile hook with its policy. Profiles are not
+// deferred, they are published again with the next metadata update.
+type guardedProfileHook struct {
+	hookScope
+	policy *hookPolicy
+	hook   NostrProfileHook
+}
+
+func (h *guardedProfileHook) BeforeProfilePublish(ctx context.Context, feed feedStruct, event *nostr.Event) (*nostr.Event, error) {
+	var updated *nostr.Event
+	err := h.policy.call(ctx, func(ctx context.Context) error {
+		var err error
+		updated, err = h.hook.BeforeProfilePublish(ctx, feed, event)
+		return err
+	})
+	if err != nil {
+		if err = h.policy.failed(err); err != nil {
+			return nil, err
+		}
+		return event, nil
+	}
+	return updated, nil
+}
+
+// guardedPostPublishHook calls a post-publish hook with its policy.
+type guardedPostPublishHook struct {
+	hookScope
+	policy *hookPolicy
+	hook   NostrPostPublishHook
+}
+
+func (h *guardedPostPublishHook) AfterPublish(ctx context.Context, feed feedStruct, feedPost feedPostStruct, event nostr.Event, results []relayResult) error {
+	return h.policy.call(ctx, func(ctx context.Context) error {
+		return h.hook.AfterPublish(ctx, feed, feedPost, event, results)
+	})
+}
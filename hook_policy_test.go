@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHookPolicyFailed(t *testing.T) {
+	errHook := errors.New("boom")
+	tests := []struct {
+		name      string
+		onError   string
+		err       error
+		wantNil   bool
+		wantDefer bool
+	}{
+		{"abort", hookOnErrorAbort, errHook, false, false},
+		{"skip", hookOnErrorSkip, errHook, true, false},
+		{"defer", hookOnErrorDefer, errHook, false, true},
+		{"abort bypasses an open breaker", hookOnErrorAbort, errHookCircuitOpen, true, false},
+		{"skip bypasses an open breaker", hookOnErrorSkip, errHookCircuitOpen, true, false},
+		{"defer waits for an open breaker", hookOnErrorDefer, errHookCircuitOpen, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &hookPolicy{name: "test", onError: tt.onError}
+			err := p.failed(tt.err)
+			if (err == nil) != tt.wantNil {
+				t.Fatalf("failed() = %v, want nil %v", err, tt.wantNil)
+			}
+			if err == nil {
+				return
+			}
+			if got := errors.Is(err, errPostDeferred); got != tt.wantDefer {
+				t.Errorf("failed() = %v, deferred %v, want %v", err, got, tt.wantDefer)
+			}
+			if !errors.Is(err, tt.err) && !tt.wantDefer {
+				t.Errorf("failed() = %v, want it to wrap %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestHookPolicyCall(t *testing.T) {
+	errHook := errors.New("boom")
+	tests := []struct {
+		name      string
+		retries   int
+		failTimes int
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", 0, 0, 1, false},
+		{"failure without retries", 0, 1, 1, true},
+		{"retried until success", 3, 2, 3, false},
+		{"retries exhausted", 2, 5, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &hookPolicy{name: "test", retries: tt.retries, retryDelay: time.Millisecond, timeout: time.Second}
+			calls := 0
+			err := p.call(context.Background(), func(context.Context) error {
+				calls++
+				if calls <= tt.failTimes {
+					return errHook
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("call() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("call() made %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestHookPolicyTimeout(t *testing.T) {
+	p := &hookPolicy{name: "test", timeout: 20 * time.Millisecond}
+	err := p.call(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("call() error = %v, want deadline exceeded", err)
+	}
+}
+
+func TestHookPolicySlotWaitIsNotTimed(t *testing.T) {
+	p := &hookPolicy{name: "test", timeout: 20 * time.Millisecond, slots: make(chan struct{}, 1)}
+	p.slots <- struct{}{}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-p.slots
+	}()
+	err := p.call(context.Background(), func(ctx context.Context) error {
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Errorf("call() error = %v, want nil", err)
+	}
+}
+
+func TestHookPolicyBreaker(t *testing.T) {
+	errHook := errors.New("boom")
+	fail := func(context.Context) error { return errHook }
+	succeed := func(context.Context) error { return nil }
+
+	p := &hookPolicy{name: "test", timeout: time.Second, breakerFailures: 2, breakerCooldown: 30 * time.Millisecond}
+	steps := []struct {
+		name    string
+		wait    time.Duration
+		fn      func(context.Context) error
+		wantErr error
+		called  bool
+	}{
+		{"first failure", 0, fail, errHook, true},
+		{"second failure opens", 0, fail, errHook, true},
+		{"open", 0, succeed, errHookCircuitOpen, false},
+		{"failed probe opens again", 40 * time.Millisecond, fail, errHook, true},
+		{"open after failed probe", 0, succeed, errHookCircuitOpen, false},
+		{"probe closes", 40 * time.Millisecond, succeed, nil, true},
+		{"closed", 0, succeed, nil, true},
+		{"one failure keeps it closed", 0, fail, errHook, true},
+		{"still closed", 0, succeed, nil, true},
+	}
+	for _, step := range steps {
+		time.Sleep(step.wait)
+		called := false
+		err := p.call(context.Background(), func(ctx context.Context) error {
+			called = true
+			return step.fn(ctx)
+		})
+		if !errors.Is(err, step.wantErr) || (err == nil) != (step.wantErr == nil) {
+			t.Errorf("%s: call() error = %v, want %v", step.name, err, step.wantErr)
+		}
+		if called != step.called {
+			t.Errorf("%s: hook called = %v, want %v", step.name, called, step.called)
+		}
+	}
+}
+
+func TestHookPolicySingleProbe(t *testing.T) {
+	p := &hookPolicy{name: "test", breakerFailures: 1, breakerCooldown: time.Millisecond}
+	p.record(errors.New("boom"))
+	time.Sleep(5 * time.Millisecond)
+
+	if !p.allow() {
+		t.Fatal("allow() = false after the cooldown, want a probe")
+	}
+	if p.allow() {
+		t.Error("allow() = true while a probe is running, want false")
+	}
+	p.record(nil)
+	if !p.allow() {
+		t.Error("allow() = false after a successful probe, want true")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// feedSelector limits a hook to some feeds: listed by url or npub, with a
+// url matching a glob or a regular expression, or with one of the tags.
+type feedSelector struct {
+	urls     map[string]bool
+	pubs     map[string]bool
+	tags     map[string]bool
+	patterns []*regexp.Regexp // globs are compiled to regular expressions
+}
+
+// newFeedSelector compiles the feeds section of a hook. A feeds section
+// without entries is an error, it would disable the hook.
+func newFeedSelector(cfg *FeedSelectorConfig) (*feedSelector, error) {
+	if len(cfg.List) == 0 && len(cfg.Glob) == 0 && len(cfg.Regex) == 0 && len(cfg.Tags) == 0 {
+		return nil, errors.New("feeds selects no feeds, remove it to run the hook for all feeds")
+	}
+	s := &feedSelector{urls: map[string]bool{}, pubs: map[string]bool{}, tags: map[string]bool{}}
+	for _, entry := range cfg.List {
+		if strings.HasPrefix(entry, "npub1") {
+			_, value, err := nip19.Decode(entry)
+			if err != nil {
+				return nil, errors.New("invalid npub " + entry)
+			}
+			s.pubs[value.(string)] = true
+		} else {
+			s.urls[entry] = true
+		}
+	}
+	for _, tag := range parseTagList(strings.Join(cfg.Tags, ",")) {
+		s.tags[tag] = true
+	}
+	for _, glob := range cfg.Glob {
+		s.patterns = append(s.patterns, compileGlob(glob))
+	}
+	for _, expr := range cfg.Regex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.New("invalid regex " + expr + ": " + err.Error())
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return s, nil
+}
+
+// compileGlob turns a url glob into a regular expression matching the whole
+// url. * and ? stay within one part of the url: they don't match /, ? or #,
+// so a * in the host can't reach into the path or the query. ** also
+// matches /, but never the query or the fragment.
+func compileGlob(glob string) *regexp.Regexp {
+	var pattern strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			pattern.WriteString(`[^?#]*`)
+			i++
+		case glob[i] == '*':
+			pattern.WriteString(`[^/?#]*`)
+		case glob[i] == '?':
+			pattern.WriteString(`[^/?#]`)
+		default:
+			pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return regexp.MustCompile("^" + pattern.String() + "$")
+}
+
+// matches reports whether the selector includes a feed. A nil selector
+// includes every feed.
+func (s *feedSelector) matches(feed feedStruct) bool {
+	if s == nil {
+		return true
+	}
+	if s.urls[feed.Url] || s.pubs[feed.Pub] {
+		return true
+	}
+	for _, tag := range feed.Tags {
+		if s.tags[tag] {
+			return true
+		}
+	}
+	for _, re := range s.patterns {
+		if re.MatchString(feed.Url) {
+			return true
+		}
+	}
+	return false
+}
+
+// feedScopedHook is implemented by hooks that only run for some feeds.
+type feedScopedHook interface {
+	appliesTo(feed feedStruct) bool
+}
+
+// hookScope is embedded in configured hooks to scope them with a selector.
+type hookScope struct {
+	feeds *feedSelector
+}
+
+func (s hookScope) appliesTo(feed feedStruct) bool {
+	return s.feeds.matches(feed)
+}
+
+// hookApplies reports whether a hook runs for a feed. Hooks registered
+// without a scope run for all feeds.
+func hookApplies(h any, feed feedStruct) bool {
+	if scoped, ok := h.(feedScopedHook); ok {
+		return scoped.appliesTo(feed)
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestFeedSelectorGlob(t *testing.T) {
+	tests := []struct {
+		name string
+		glob string
+		url  string
+		want bool
+	}{
+		{"exact", "https://example.com/rss", "https://example.com/rss", true},
+		{"star matches a path segment", "https://example.com/*", "https://example.com/rss", true},
+		{"star stops at slashes", "https://example.com/*", "https://example.com/blog/rss", false},
+		{"double star matches slashes", "https://example.com/**", "https://example.com/blog/rss", true},
+		{"double star in front", "**/rss/news/**", "https://example.com/rss/news/world", true},
+		{"star matches nothing", "https://example.com/rss*", "https://example.com/rss", true},
+		{"star matches a subdomain", "https://*.example.com/**", "https://news.example.com/rss", true},
+		{"star stays in the host", "https://*.example.com/**", "https://evil.com/?x=.example.com/", false},
+		{"leading star stays in one part", "*.example.com/*", "https://evil.com/?x=.example.com/", false},
+		{"star stops at the query", "https://*.example.com/**", "https://evil.com?.example.com/", false},
+		{"double star stops at the query", "https://example.com/**", "https://example.com/rss?x=/", false},
+		{"star stops at the fragment", "https://*.example.com/**", "https://evil.com#.example.com/", false},
+		{"question mark matches one character", "https://example.com/feed?.xml", "https://example.com/feed2.xml", true},
+		{"question mark needs a character", "https://example.com/feed?.xml", "https://example.com/feed.xml", false},
+		{"question mark doesn't match a slash", "https://example.com/feed?xml", "https://example.com/feed/xml", false},
+		{"anchored at the start", "example.com/*", "https://example.com/rss", false},
+		{"anchored at the end", "https://example.com/rss", "https://example.com/rss.xml", false},
+		{"dots are literal", "https://example.com/feed.xml", "https://example.com/feedXxml", false},
+		{"regex characters are literal", "https://example.com/(a|b)+", "https://example.com/a", false},
+		{"brackets are literal", "https://example.com/[ab]", "https://example.com/[ab]", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newFeedSelector(&FeedSelectorConfig{Glob: []string{tt.glob}})
+			if err != nil {
+				t.Fatalf("newFeedSelector() error = %v", err)
+			}
+			if got := s.matches(feedStruct{Url: tt.url}); got != tt.want {
+				t.Errorf("glob %q matches %q = %v, want %v", tt.glob, tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeedSelector(t *testing.T) {
+	pub, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	npub, _ := nip19.EncodePublicKey(pub)
+
+	tests := []struct {
+		name    string
+		cfg     *FeedSelectorConfig
+		feed    feedStruct
+		want    bool
+		wantErr bool
+	}{
+		{"listed url", &FeedSelectorConfig{List: []string{"https://a.example/rss"}}, feedStruct{Url: "https://a.example/rss"}, true, false},
+		{"unlisted url", &FeedSelectorConfig{List: []string{"https://a.example/rss"}}, feedStruct{Url: "https://b.example/rss"}, false, false},
+		{"listed npub", &FeedSelectorConfig{List: []string{npub}}, feedStruct{Url: "https://b.example/rss", Pub: pub}, true, false},
+		{"regex", &FeedSelectorConfig{Regex: []string{`^https://[a-z]+\.example/`}}, feedStruct{Url: "https://news.example/rss"}, true, false},
+		{"regex is not anchored", &FeedSelectorConfig{Regex: []string{`example`}}, feedStruct{Url: "https://news.example/rss"}, true, false},
+		{"any entry matches", &FeedSelectorConfig{List: []string{"https://a.example/rss"}, Glob: []string{"https://*.org/*"}}, feedStruct{Url: "https://c.org/feed"}, true, false},
+		{"tag", &FeedSelectorConfig{Tags: []string{"news"}}, feedStruct{Url: "https://a.example/rss", Tags: []string{"tech", "news"}}, true, false},
+		{"tag case ignored", &FeedSelectorConfig{Tags: []string{"News"}}, feedStruct{Url: "https://a.example/rss", Tags: []string{"news"}}, true, false},
+		{"other tag", &FeedSelectorConfig{Tags: []string{"news"}}, feedStruct{Url: "https://a.example/rss", Tags: []string{"tech"}}, false, false},
+		{"untagged feed", &FeedSelectorConfig{Tags: []string{"news"}}, feedStruct{Url: "https://a.example/rss"}, false, false},
+		{"invalid npub", &FeedSelectorConfig{List: []string{"npub1invalid"}}, feedStruct{}, false, true},
+		{"invalid regex", &FeedSelectorConfig{Regex: []string{"("}}, feedStruct{}, false, true},
+		{"empty", &FeedSelectorConfig{}, feedStruct{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newFeedSelector(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newFeedSelector() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := s.matches(tt.feed); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.feed.Url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHookApplies(t *testing.T) {
+	s, _ := newFeedSelector(&FeedSelectorConfig{List: []string{"https://a.example/rss"}})
+	tests := []struct {
+		name string
+		hook any
+		feed feedStruct
+		want bool
+	}{
+		{"unscoped hook", &WebhookHook{}, feedStruct{Url: "https://b.example/rss"}, true},
+		{"scope without selector", &guardedEventHook{}, feedStruct{Url: "https://b.example/rss"}, true},
+		{"selected feed", &guardedEventHook{hookScope: hookScope{feeds: s}}, feedStruct{Url: "https://a.example/rss"}, true},
+		{"other feed", &guardedEventHook{hookScope: hookScope{feeds: s}}, feedStruct{Url: "https://b.example/rss"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hookApplies(tt.hook, tt.feed); got != tt.want {
+				t.Errorf("hookApplies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -21,15 +22,43 @@ type NostrEventHook interface {
 	BeforePublish(ctx context.Context, feed feedStruct, feedPost feedPostStruct, event *nostr.Event) (*nostr.Event, error)
 }
 
+// NostrProfileHook defines a hook invoked before the kind 0 profile of a feed
+// is signed/published. It can modify the event or return an error to skip
+// publishing the profile.
+type NostrProfileHook interface {
+	BeforeProfilePublish(ctx context.Context, feed feedStruct, event *nostr.Event) (*nostr.Event, error)
+}
+
+// NostrPostPublishHook defines a hook invoked after the event of a post was
+// published. It gets the signed event and the result of every relay and can't
+// change or stop publishing, errors are only logged.
+type NostrPostPublishHook interface {
+	AfterPublish(ctx context.Context, feed feedStruct, feedPost feedPostStruct, event nostr.Event, results []relayResult) error
+}
+
 // RegisterPrePublishHook appends a hook to the Atomstr instance.
 func (a *Atomstr) RegisterPrePublishHook(h NostrEventHook) {
 	a.prePublishHooks = append(a.prePublishHooks, h)
 }
 
-// runPrePublishHooks executes hooks sequentially, passing the event through.
+// RegisterPreProfilePublishHook appends a profile hook to the Atomstr instance.
+func (a *Atomstr) RegisterPreProfilePublishHook(h NostrProfileHook) {
+	a.preProfilePublishHooks = append(a.preProfilePublishHooks, h)
+}
+
+// RegisterPostPublishHook appends a post-publish hook to the Atomstr instance.
+func (a *Atomstr) RegisterPostPublishHook(h NostrPostPublishHook) {
+	a.postPublishHooks = append(a.postPublishHooks, h)
+}
+
+// runPrePublishHooks executes the hooks of the feed sequentially, passing the
+// event through.
 func (a *Atomstr) runPrePublishHooks(ctx context.Context, feed feedStruct, post feedPostStruct, ev *nostr.Event) (*nostr.Event, error) {
 	current := ev
 	for _, h := range a.prePublishHooks {
+		if !hookApplies(h, feed) {
+			continue
+		}
 		updated, err := h.BeforePublish(ctx, feed, post, current)
 		if err != nil {
 			return nil, err
@@ -42,8 +71,95 @@ func (a *Atomstr) runPrePublishHooks(ctx context.Context, feed feedStruct, post
 	return current, nil
 }
 
+// runPreProfilePublishHooks executes the profile hooks of the feed
+// sequentially, passing the event through.
+func (a *Atomstr) runPreProfilePublishHooks(ctx context.Context, feed feedStruct, ev *nostr.Event) (*nostr.Event, error) {
+	current := ev
+	for _, h := range a.preProfilePublishHooks {
+		if !hookApplies(h, feed) {
+			continue
+		}
+		updated, err := h.BeforeProfilePublish(ctx, feed, current)
+		if err != nil {
+			return nil, err
+		}
+		if updated == nil {
+			return nil, errors.New("hook returned nil event")
+		}
+		current = updated
+	}
+	return current, nil
+}
+
+// postPublishQueueSize limits the posts waiting for their post-publish hooks,
+// the hooks of further posts are skipped until the queue has room.
+const postPublishQueueSize = 100
+
+// postPublishWorkers is the number of posts whose post-publish hooks run at
+// the same time.
+const postPublishWorkers = 2
+
+// postPublishTask is a published post waiting for its post-publish hooks.
+type postPublishTask struct {
+	ctx     context.Context
+	feed    feedStruct
+	post    feedPostStruct
+	ev      nostr.Event
+	results []relayResult
+	hooks   []NostrPostPublishHook
+}
+
+// runPostPublishHooks queues the post-publish hooks of a post, so slow
+// endpoints don't hold up the feed. Workers are started as needed and stop
+// when the queue is empty.
+func (a *Atomstr) runPostPublishHooks(ctx context.Context, feed feedStruct, post feedPostStruct, ev nostr.Event, results []relayResult) {
+	hooks := []NostrPostPublishHook{}
+	for _, h := range a.postPublishHooks {
+		if hookApplies(h, feed) {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	task := postPublishTask{ctx: ctx, feed: feed, post: post, ev: ev, results: results, hooks: hooks}
+	select {
+	case a.postPublishQueue <- task:
+	default:
+		log.Println("[WARN] Post-publish hook queue is full, skipping hooks of", ev.ID)
+		return
+	}
+
+	a.postPublishMu.Lock()
+	defer a.postPublishMu.Unlock()
+	if a.postPublishRunning < postPublishWorkers {
+		a.postPublishRunning++
+		a.spawn(a.postPublishWorker)
+	}
+}
+
+// postPublishWorker runs queued post-publish hooks until the queue is empty.
+func (a *Atomstr) postPublishWorker() {
+	for {
+		a.postPublishMu.Lock()
+		select {
+		case task := <-a.postPublishQueue:
+			a.postPublishMu.Unlock()
+			for _, h := range task.hooks {
+				if err := h.AfterPublish(task.ctx, task.feed, task.post, task.ev, task.results); err != nil {
+					log.Println("[ERROR] post-publish hook failed:", err)
+				}
+			}
+		default:
+			a.postPublishRunning--
+			a.postPublishMu.Unlock()
+			return
+		}
+	}
+}
+
 // RestEnrichHook calls an external REST endpoint to enrich a Nostr event.
-// It sends feedItem and nostrEvent and expects {result:"success"|"error", nostrEvent:{...}}.
+// It sends feedItem, feedPost (not for profiles) and nostrEvent and expects {result:"success"|"error", nostrEvent:{...}}.
 type RestEnrichHook struct {
 	url     string
 	method  string
@@ -79,9 +195,9 @@ func NewRestEnrichHook(rawURL, method string, headers map[string]string, compose
 }
 
 type restHookRequest struct {
-	Feed       feedStruct     `json:"feed"`
-	FeedPost   feedPostStruct `json:"feedPost"`
-	NostrEvent nostr.Event    `json:"nostrEvent"`
+	Feed       feedStruct      `json:"feed"`
+	FeedPost   *feedPostStruct `json:"feedPost,omitempty"`
+	NostrEvent nostr.Event     `json:"nostrEvent"`
 }
 
 type restHookResponse struct {
@@ -90,8 +206,14 @@ type restHookResponse struct {
 }
 
 func (h *RestEnrichHook) BeforePublish(ctx context.Context, feed feedStruct, feedPost feedPostStruct, event *nostr.Event) (*nostr.Event, error) {
-	payload := restHookRequest{Feed: feed, FeedPost: feedPost, NostrEvent: *event}
+	return h.enrich(ctx, restHookRequest{Feed: feed, FeedPost: &feedPost, NostrEvent: *event}, event)
+}
 
+func (h *RestEnrichHook) BeforeProfilePublish(ctx context.Context, feed feedStruct, event *nostr.Event) (*nostr.Event, error) {
+	return h.enrich(ctx, restHookRequest{Feed: feed, NostrEvent: *event}, event)
+}
+
+func (h *RestEnrichHook) enrich(ctx context.Context, payload restHookRequest, event *nostr.Event) (*nostr.Event, error) {
 	var req *http.Request
 	var err error
 
@@ -100,10 +222,6 @@ func (h *RestEnrichHook) BeforePublish(ctx context.Context, feed feedStruct, fee
 		if err != nil {
 			return nil, err
 		}
-		postJSON, err := json.Marshal(payload.FeedPost)
-		if err != nil {
-			return nil, err
-		}
 		evJSON, err := json.Marshal(payload.NostrEvent)
 		if err != nil {
 			return nil, err
@@ -114,7 +232,13 @@ func (h *RestEnrichHook) BeforePublish(ctx context.Context, feed feedStruct, fee
 		}
 		q := u.Query()
 		q.Set("feed", string(feedJSON))
-		q.Set("feedPost", string(postJSON))
+		if payload.FeedPost != nil {
+			postJSON, err := json.Marshal(payload.FeedPost)
+			if err != nil {
+				return nil, err
+			}
+			q.Set("feedPost", string(postJSON))
+		}
 		q.Set("nostrEvent", string(evJSON))
 		u.RawQuery = q.Encode()
 		method := h.method
@@ -159,20 +283,26 @@ func (h *RestEnrichHook) BeforePublish(ctx context.Context, feed feedStruct, fee
 	}
 
 	if h.parse == "jsonParse" {
-		var out restHookResponse
-		dec := json.NewDecoder(resp.Body)
-		if err := dec.Decode(&out); err != nil {
-			return nil, err
-		}
-		if strings.ToLower(out.Result) != "success" {
-			return nil, errors.New("rest hook returned error result")
-		}
-		if out.NostrEvent == nil {
-			log.Println("[WARN] REST hook success but no nostrEvent in response; using original event")
-			return event, nil
-		}
-		return out.NostrEvent, nil
+		return decodeHookResponse(resp.Body, event, "REST")
 	}
 	// Default parser: passthrough
 	return event, nil
 }
+
+// decodeHookResponse reads a restHookResponse. It returns the original event
+// if the response has none.
+func decodeHookResponse(r io.Reader, event *nostr.Event, kind string) (*nostr.Event, error) {
+	var out restHookResponse
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	if strings.ToLower(out.Result) != "success" {
+		return nil, errors.New(strings.ToLower(kind) + " hook returned error result")
+	}
+	if out.NostrEvent == nil {
+		log.Println("[WARN] " + kind + " hook success but no nostrEvent in response; using original event")
+		return event, nil
+	}
+	return out.NostrEvent, nil
+}
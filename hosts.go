@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitDefault is how long a host is left alone after a 429 without
+// Retry-After header.
+var rateLimitDefault = 10 * time.Minute
+
+// rateLimitedError is returned for requests to a host that asked us to slow
+// down, until the time it gave us has passed.
+type rateLimitedError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("%s is rate limited until %s", e.Host, e.Until.UTC().Format(time.DateTime))
+}
+
+// hostState is the politeness state of one host.
+type hostState struct {
+	slots        chan struct{} // one per request in flight
+	next         time.Time     // earliest start of the next request
+	blockedUntil time.Time     // from 429 and Retry-After
+}
+
+// hostLimiter keeps the requests to every host below HOST_MAX_CONNECTIONS
+// and at least HOST_MIN_DELAY apart.
+type hostLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{hosts: map[string]*hostState{}}
+}
+
+// feedHosts limits the requests of feedHttpClient.
+var feedHosts = newHostLimiter()
+
+// hostSlotKey marks a context that already holds a slot of a host.
+type hostSlotKey struct{}
+
+// acquireHostSlot waits for a slot of the host of rawUrl before a fetch
+// timeout is started, so waiting for politeness doesn't make the fetch fail.
+// Requests with the returned context use the slot instead of taking another
+// one. release has to be called once the response was read.
+func acquireHostSlot(ctx context.Context, rawUrl string) (context.Context, func(), error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ctx, func() {}, nil // the request reports the bad url
+	}
+	host := strings.ToLower(u.Hostname())
+	release, err := feedHosts.acquire(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	return context.WithValue(ctx, hostSlotKey{}, host), release, nil
+}
+
+// releaseOnClose frees the slot of a request once its body is closed, so
+// downloads count against HOST_MAX_CONNECTIONS too.
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func (l *hostLimiter) host(name string) *hostState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &hostState{slots: make(chan struct{}, max(hostMaxConnections, 1))}
+		l.hosts[name] = h
+	}
+	return h
+}
+
+// acquire waits for a free slot and the minimum delay of a host. The returned
+// function releases the slot.
+func (l *hostLimiter) acquire(ctx context.Context, name string) (func(), error) {
+	h := l.host(name)
+	if until := l.blocked(h); !until.IsZero() {
+		return nil, &rateLimitedError{Host: name, Until: until}
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-h.slots }
+
+	l.mu.Lock()
+	start := time.Now()
+	if h.next.After(start) {
+		start = h.next
+	}
+	h.next = start.Add(hostMinDelay)
+	l.mu.Unlock()
+
+	if wait := time.Until(start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// blocked returns until when a host is rate limited, or the zero time.
+func (l *hostLimiter) blocked(h *hostState) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Now().Before(h.blockedUntil) {
+		return h.blockedUntil
+	}
+	return time.Time{}
+}
+
+func (l *hostLimiter) block(name string, until time.Time) {
+	h := l.host(name)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(h.blockedUntil) {
+		h.blockedUntil = until
+	}
+}
+
+// parseRetryAfter reads a Retry-After header, given in seconds or as a date.
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// politeTransport limits requests per host and honors 429 and Retry-After.
+type politeTransport struct {
+	base    http.RoundTripper
+	limiter *hostLimiter
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	release := func() {}
+	if held, _ := req.Context().Value(hostSlotKey{}).(string); held != host {
+		var err error
+		if release, err = t.limiter.acquire(req.Context(), host); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	now := time.Now()
+	until, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		if !ok {
+			until = now.Add(rateLimitDefault)
+		}
+	case resp.StatusCode == http.StatusServiceUnavailable && ok:
+	default:
+		resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+		return resp, nil
+	}
+	release()
+	if until.Sub(now) > feedBackoffMax {
+		until = now.Add(feedBackoffMax)
+	}
+	resp.Body.Close()
+	log.Printf("[WARN] %s answered %s, pausing requests until %s\n", host, resp.Status, until.UTC().Format(time.DateTime))
+	t.limiter.block(host, until)
+	return nil, &rateLimitedError{Host: host, Until: until}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Time
+		wantOk bool
+	}{
+		{"empty", "", time.Time{}, false},
+		{"seconds", "120", now.Add(2 * time.Minute), true},
+		{"zero seconds", "0", now, true},
+		{"padded seconds", " 30 ", now.Add(30 * time.Second), true},
+		{"negative seconds", "-5", time.Time{}, false},
+		{"http date", "Wed, 01 May 2024 13:00:00 GMT", now.Add(time.Hour), true},
+		{"garbage", "soon", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			if ok != tt.wantOk || !got.Equal(tt.want) {
+				t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
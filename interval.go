@@ -0,0 +1,332 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// feedIntervalAdaptive lets a feed be fetched at a rate learned from how
+// often it posts.
+const feedIntervalAdaptive = "adaptive"
+
+// intervalJitter spreads fetches by up to this fraction of the interval.
+const intervalJitter = 0.1
+
+// scrapeQueuePoll is the longest the scrape loop sleeps, so new feeds and
+// changed intervals are picked up.
+var scrapeQueuePoll = time.Minute
+
+// postIntervalSamples is how many of the latest posts are used to learn the
+// posting frequency.
+const postIntervalSamples = 20
+
+// fetchInterval returns how often the feed is fetched.
+func (feedItem *feedStruct) fetchInterval() time.Duration {
+	switch feedItem.Interval {
+	case "":
+		return fetchInterval
+	case feedIntervalAdaptive:
+		return adaptiveInterval(feedItem.PostInterval)
+	}
+	d, err := parseDurationWithDays(feedItem.Interval)
+	if err != nil {
+		return fetchInterval
+	}
+	return d
+}
+
+// adaptiveInterval fetches four times per average posting gap, within
+// ADAPTIVE_MIN_INTERVAL and ADAPTIVE_MAX_INTERVAL.
+func adaptiveInterval(postInterval int64) time.Duration {
+	if postInterval <= 0 {
+		return fetchInterval
+	}
+	d := time.Duration(postInterval) * time.Second / 4
+	if d < adaptiveMinInterval {
+		d = adaptiveMinInterval
+	}
+	if d > adaptiveMaxInterval {
+		d = adaptiveMaxInterval
+	}
+	return d
+}
+
+// withJitter randomly shifts d by up to intervalJitter in both directions.
+func withJitter(d time.Duration) time.Duration {
+	spread := int64(float64(d) * intervalJitter)
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// firstFetch picks when a feed without a schedule is fetched: after an
+// upgrade, a resume or a changed interval. They are spread over twice the
+// jitter of their interval instead of all being due at once.
+func firstFetch(feedItem feedStruct) int64 {
+	spread := int64(2 * float64(feedItem.fetchInterval()) * intervalJitter)
+	return time.Now().Add(time.Duration(rand.Int63n(spread + 1))).Unix()
+}
+
+// medianGap returns the median number of seconds between the timestamps.
+func medianGap(timestamps []int64) int64 {
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] > timestamps[j] })
+	if len(timestamps) > postIntervalSamples {
+		timestamps = timestamps[:postIntervalSamples]
+	}
+	gaps := []int64{}
+	for i := 1; i < len(timestamps); i++ {
+		if gap := timestamps[i-1] - timestamps[i]; gap > 0 {
+			gaps = append(gaps, gap)
+		}
+	}
+	if len(gaps) == 0 {
+		return 0
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	return gaps[len(gaps)/2]
+}
+
+// learnPostInterval updates the posting frequency of a feed from the item
+// dates, or from the publishing history if the items are not dated.
+func (a *Atomstr) learnPostInterval(feedItem feedStruct, items []*gofeed.Item) {
+	timestamps := []int64{}
+	for _, item := range items {
+		if item.PublishedParsed != nil {
+			timestamps = append(timestamps, item.PublishedParsed.Unix())
+		} else if item.UpdatedParsed != nil {
+			timestamps = append(timestamps, item.UpdatedParsed.Unix())
+		}
+	}
+	observed := medianGap(timestamps)
+	if observed == 0 {
+		observed = medianGap(a.dbGetPublishTimes(feedItem.Url))
+	}
+	if observed == 0 {
+		return
+	}
+
+	postInterval := observed
+	if feedItem.PostInterval > 0 {
+		// smooth out single bursts
+		postInterval = (3*feedItem.PostInterval + observed) / 4
+	}
+	if postInterval != feedItem.PostInterval {
+		log.Printf("[DEBUG] Feed %s posts every %v\n", feedItem.Url, time.Duration(postInterval)*time.Second)
+		a.dbSetPostInterval(feedItem.Url, postInterval)
+	}
+}
+
+// feedQueue is a priority queue of feeds, the next due fetch first.
+type feedQueue []feedStruct
+
+func (q feedQueue) Len() int           { return len(q) }
+func (q feedQueue) Less(i, j int) bool { return q[i].NextFetch < q[j].NextFetch }
+func (q feedQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *feedQueue) Push(x any)        { *q = append(*q, x.(feedStruct)) }
+func (q *feedQueue) Pop() any {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// scrapeTask is a due feed handed to a scrape worker.
+type scrapeTask struct {
+	feed feedStruct
+	run  *runStruct
+}
+
+// scrapeLoop fetches every feed when it is due. MAX_WORKERS long-lived
+// workers take due feeds in order, a slow feed only holds up its own worker.
+// A scrape run lasts while feeds are being fetched and ends once the workers
+// are idle; every feed is scheduled again according to its interval.
+func (a *Atomstr) scrapeLoop(ctx context.Context) {
+	tasks := make(chan scrapeTask)
+	done := make(chan string)
+	wg := sync.WaitGroup{}
+	for t := 0; t < maxWorkers; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				a.scrapeFeed(ctx, task.run, task.feed)
+				done <- task.feed.Url
+			}
+		}()
+	}
+
+	var run *runStruct
+	inFlight := map[string]bool{}
+	endRun := func(outcome string) {
+		a.sched.end(run, outcome)
+		a.dbFinishRun(run)
+		log.Printf("[INFO] Stop scrape: %d feeds, %d failed, %d skipped\n", run.Feeds, run.Failed, run.Skipped)
+		run = nil
+	}
+
+dispatch:
+	for ctx.Err() == nil {
+		queue := feedQueue{}
+		for _, feedItem := range *a.dbGetActiveFeeds() {
+			if inFlight[feedItem.Url] {
+				continue
+			}
+			if feedItem.NextFetch == 0 {
+				feedItem.NextFetch = firstFetch(feedItem)
+				a.dbSetNextFetch(feedItem.Url, feedItem.NextFetch)
+			}
+			queue = append(queue, feedItem)
+		}
+		heap.Init(&queue)
+
+		now := time.Now().Unix()
+		for queue.Len() > 0 && queue[0].NextFetch <= now {
+			feedItem := heap.Pop(&queue).(feedStruct)
+			if run == nil {
+				var ok bool
+				if run, ok = a.sched.begin("scrape"); !ok {
+					log.Println("[ERROR] Another scrape run is in progress")
+					break dispatch
+				}
+				a.sched.setRunId(run, a.dbStartRun(run))
+				log.Println("[INFO] Start scrape")
+			}
+			for sent := false; !sent; {
+				select {
+				case tasks <- scrapeTask{feed: feedItem, run: run}:
+					inFlight[feedItem.Url] = true
+					sent = true
+				case feedUrl := <-done:
+					delete(inFlight, feedUrl)
+				case <-ctx.Done():
+					break dispatch
+				}
+			}
+		}
+
+		wait := scrapeQueuePoll
+		if queue.Len() > 0 {
+			if until := time.Until(time.Unix(queue[0].NextFetch, 0)); until < wait {
+				wait = until
+			}
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		// a finished feed is scheduled again, so look at the queue again
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			break dispatch
+		case feedUrl := <-done:
+			timer.Stop()
+			delete(inFlight, feedUrl)
+			if len(inFlight) == 0 && run != nil {
+				endRun(runDone)
+			}
+		case <-timer.C:
+		}
+	}
+
+	close(tasks)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for range done {
+	}
+	if run != nil {
+		log.Println("[INFO] Interrupted scrape")
+		endRun(runInterrupted)
+	}
+}
+
+// scrapeFeed fetches one feed of a scrape run and schedules its next fetch.
+func (a *Atomstr) scrapeFeed(ctx context.Context, run *runStruct, feedItem feedStruct) {
+	if !a.sched.tryLockFeed(feedItem.Url) {
+		log.Println("[DEBUG] Feed busy, skipping", feedItem.Url)
+		a.sched.count(run, true, nil)
+		a.scheduleNextFetch(feedItem.Url, true)
+		return
+	}
+	err := a.processFeedUrl(ctx, feedItem)
+	a.sched.unlockFeed(feedItem.Url)
+	a.sched.count(run, false, err)
+	if ctx.Err() == nil {
+		a.finishFetch(feedItem.Url, err)
+	}
+}
+
+// finishFetch records the result of a scrape and schedules the next one. A
+// rate limited host is not the fault of the feed, it is just fetched again
+// once the host allows it.
+func (a *Atomstr) finishFetch(feedUrl string, fetchErr error) {
+	var limited *rateLimitedError
+	if errors.As(fetchErr, &limited) {
+		a.dbSetNextFetch(feedUrl, limited.Until.Unix())
+		return
+	}
+	a.recordFetchResult(feedUrl, fetchErr)
+	a.scheduleNextFetch(feedUrl, false)
+}
+
+// scheduleNextFetch sets when a feed is fetched next. Feeds that were busy
+// are retried soon, failing ones back off.
+func (a *Atomstr) scheduleNextFetch(feedUrl string, busy bool) {
+	feedItem := a.dbGetFeed(feedUrl)
+	if feedItem.Url == "" {
+		return // removed meanwhile
+	}
+	interval := feedItem.backoffInterval()
+	if busy {
+		interval = scrapeQueuePoll
+	}
+	a.dbSetNextFetch(feedUrl, time.Now().Add(withJitter(interval)).Unix())
+}
+
+func (a *Atomstr) dbSetNextFetch(feedUrl string, nextFetch int64) {
+	_, err := a.db.Exec(`UPDATE feeds SET next_fetch_at=? WHERE url=?;`, nextFetch, feedUrl)
+	if err != nil {
+		log.Println("[ERROR] Can't schedule feed:", err)
+	}
+}
+
+func (a *Atomstr) dbSetPostInterval(feedUrl string, postInterval int64) {
+	_, err := a.db.Exec(`UPDATE feeds SET post_interval=? WHERE url=?;`, postInterval, feedUrl)
+	if err != nil {
+		log.Println("[ERROR] Can't store post interval:", err)
+	}
+}
+
+// dbGetPublishTimes returns when the latest posts of a feed were published.
+func (a *Atomstr) dbGetPublishTimes(feedUrl string) []int64 {
+	sqlStatement := `SELECT published_at FROM published_posts WHERE feed_url=? ORDER BY published_at DESC LIMIT ?;`
+	rows, err := a.db.Query(sqlStatement, feedUrl, postIntervalSamples)
+	if err != nil {
+		log.Println("[ERROR] Failed to read published posts:", err)
+		return nil
+	}
+	defer rows.Close()
+
+	timestamps := []int64{}
+	for rows.Next() {
+		var ts int64
+		if err := rows.Scan(&ts); err != nil {
+			log.Println("[ERROR] Scanning published posts failed:", err)
+			return nil
+		}
+		timestamps = append(timestamps, ts)
+	}
+	return timestamps
+}
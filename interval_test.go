@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMedianGap(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamps []int64
+		want       int64
+	}{
+		{"none", nil, 0},
+		{"single", []int64{100}, 0},
+		{"two", []int64{100, 400}, 300},
+		{"unsorted", []int64{700, 100, 300}, 400},
+		{"median of odd gaps", []int64{0, 10, 30, 130}, 20},
+		{"upper median of even gaps", []int64{0, 10, 30, 60, 100}, 30},
+		{"duplicate timestamps ignored", []int64{100, 100, 100, 200}, 100},
+		{"all equal", []int64{5, 5, 5}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := medianGap(tt.timestamps); got != tt.want {
+				t.Errorf("medianGap(%v) = %d, want %d", tt.timestamps, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMedianGapUsesLatestSamples(t *testing.T) {
+	// old posts a day apart, the latest ones an hour apart
+	timestamps := []int64{}
+	for i := int64(0); i < 10; i++ {
+		timestamps = append(timestamps, i*86400)
+	}
+	for i := int64(1); i <= postIntervalSamples; i++ {
+		timestamps = append(timestamps, 10*86400+i*3600)
+	}
+	if got := medianGap(timestamps); got != 3600 {
+		t.Errorf("medianGap() = %d, want 3600", got)
+	}
+}
+
+func TestAdaptiveInterval(t *testing.T) {
+	tests := []struct {
+		name         string
+		postInterval int64
+		want         time.Duration
+	}{
+		{"unknown", 0, fetchInterval},
+		{"negative", -60, fetchInterval},
+		{"quarter of the gap", int64(4 * time.Hour / time.Second), time.Hour},
+		{"at least the minimum", 60, adaptiveMinInterval},
+		{"at most the maximum", int64(30 * 24 * time.Hour / time.Second), adaptiveMaxInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := adaptiveInterval(tt.postInterval); got != tt.want {
+				t.Errorf("adaptiveInterval(%d) = %v, want %v", tt.postInterval, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstFetch(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval string
+		spread   time.Duration
+	}{
+		{"hourly", "1h", 12 * time.Minute},
+		{"daily", "1d", 288 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				now := time.Now().Unix()
+				got := firstFetch(feedStruct{Interval: tt.interval})
+				if got < now || got > now+int64(tt.spread/time.Second)+1 {
+					t.Fatalf("firstFetch() = now%+ds, want within %v", got-now, tt.spread)
+				}
+			}
+		})
+	}
+}
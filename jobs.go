@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// Job kinds
+const (
+	jobAddFeed    = "add-feed"    // announce a new feed and publish its history
+	jobImportFeed = "import-feed" // validate and store a feed, then continue as add-feed
+	jobPurgeFeed  = "purge-feed"  // publish deletions for a feed, then remove it
+)
+
+// Job states
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+var jobPollInterval = time.Minute
+
+// jobStruct is a unit of background work and its progress.
+type jobStruct struct {
+	Id         string `json:"id"`
+	Kind       string `json:"kind"`
+	FeedUrl    string `json:"feed_url"`
+	State      string `json:"state"`
+	Fetched    int    `json:"fetched"`
+	Published  int    `json:"published"`
+	Skipped    int    `json:"skipped"`
+	Failed     int    `json:"failed"`
+	Error      string `json:"error,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+	StartedAt  int64  `json:"started_at,omitempty"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+	Settings   string `json:"-"` // feedSettings of an import-feed job as JSON
+}
+
+// Finished reports whether the job will not change anymore.
+func (job *jobStruct) Finished() bool {
+	return job.State == jobDone || job.State == jobFailed
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("[ERROR] Can't generate job id: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// addSourceAsync adds a feed and leaves announcing it and publishing its
+// history to a background job. It returns as soon as the feed is stored, the
+// job is nil if it could not be queued.
+func (a *Atomstr) addSourceAsync(ctx context.Context, feedUrl string, settings feedSettings) (*feedStruct, *jobStruct, error) {
+	feedItem, err := a.createSource(ctx, feedUrl, settings)
+	if err != nil {
+		return feedItem, nil, err
+	}
+
+	job := &jobStruct{
+		Id:        newJobId(),
+		Kind:      jobAddFeed,
+		FeedUrl:   feedItem.Url,
+		State:     jobQueued,
+		CreatedAt: time.Now().Unix(),
+	}
+	// the feed was just fetched to validate it, the job doesn't fetch it again
+	a.keepJobFeed(job.Id, feedItem)
+	if !a.dbWriteJob(job) {
+		// the feed is added anyway, its profile and posts wait for the next
+		// metadata and scrape runs of the feed
+		log.Println("[WARN] Can't queue job for", feedItem.Url)
+		a.takeJobFeed(job.Id)
+		return feedItem, nil, nil
+	}
+	log.Println("[INFO] Queued job", job.Id, "for", feedItem.Url)
+	a.wakeJobRunner()
+	return feedItem, job, nil
+}
+
+// purgeSourceAsync queues a job that purges and removes a feed.
+func (a *Atomstr) purgeSourceAsync(feedUrl string) (*jobStruct, error) {
+	job := &jobStruct{
+		Id:        newJobId(),
+		Kind:      jobPurgeFeed,
+		FeedUrl:   feedUrl,
+		State:     jobQueued,
+		CreatedAt: time.Now().Unix(),
+	}
+	if !a.dbWriteJob(job) {
+		return nil, errors.New("can't write job")
+	}
+	log.Println("[INFO] Queued job", job.Id, "to purge", feedUrl)
+	a.wakeJobRunner()
+	return job, nil
+}
+
+// keepJobFeed stores the fetched feed for the add-feed job with the given id.
+func (a *Atomstr) keepJobFeed(jobId string, feedItem *feedStruct) {
+	a.jobFeedsMu.Lock()
+	defer a.jobFeedsMu.Unlock()
+	if a.jobFeeds == nil {
+		a.jobFeeds = map[string]*feedStruct{}
+	}
+	a.jobFeeds[jobId] = feedItem
+}
+
+// takeJobFeed removes and returns the feed kept for a job, nil if there is
+// none, e.g. because the job was queued before a restart.
+func (a *Atomstr) takeJobFeed(jobId string) *feedStruct {
+	a.jobFeedsMu.Lock()
+	defer a.jobFeedsMu.Unlock()
+	feedItem := a.jobFeeds[jobId]
+	delete(a.jobFeeds, jobId)
+	return feedItem
+}
+
+func (a *Atomstr) wakeJobRunner() {
+	select {
+	case a.jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// jobRunner works through the queued jobs one after another. Jobs that were
+// running when atomstr stopped are started again.
+func (a *Atomstr) jobRunner(ctx context.Context) {
+	a.dbRequeueRunningJobs()
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		for _, job := range a.dbGetJobsByState(jobQueued) {
+			if ctx.Err() != nil {
+				return
+			}
+			a.runJob(ctx, job)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.jobWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Atomstr) runJob(ctx context.Context, job *jobStruct) {
+	log.Println("[INFO] Starting job", job.Id, job.Kind, job.FeedUrl)
+	job.State = jobRunning
+	job.StartedAt = time.Now().Unix()
+	a.dbUpdateJob(job)
+
+	var err error
+	switch job.Kind {
+	case jobAddFeed:
+		err = a.runAddFeedJob(ctx, job, a.takeJobFeed(job.Id))
+	case jobImportFeed:
+		err = a.runImportFeedJob(ctx, job)
+	case jobPurgeFeed:
+		err = a.deleteSource(ctx, job.FeedUrl, true)
+	default:
+		err = errors.New("unknown job kind " + job.Kind)
+	}
+
+	if ctx.Err() != nil {
+		log.Println("[INFO] Job", job.Id, "interrupted, it is resumed on the next start")
+		job.State = jobQueued
+		a.dbUpdateJob(job)
+		return
+	}
+	job.FinishedAt = time.Now().Unix()
+	if err != nil {
+		log.Println("[ERROR] Job", job.Id, "failed:", err)
+		job.State = jobFailed
+		job.Error = err.Error()
+	} else {
+		log.Printf("[INFO] Job %s done: %d fetched, %d published, %d skipped, %d failed\n", job.Id, job.Fetched, job.Published, job.Skipped, job.Failed)
+		job.State = jobDone
+	}
+	a.dbUpdateJob(job)
+}
+
+// runAddFeedJob announces a feed and publishes its history. fetched is the
+// feed as fetched when it was added, without it the feed is fetched again.
+func (a *Atomstr) runAddFeedJob(ctx context.Context, job *jobStruct, fetched *feedStruct) error {
+	feedItem := a.dbGetFeed(job.FeedUrl)
+	if feedItem.Url == "" {
+		return errors.New("feed was removed")
+	}
+	if !a.sched.lockFeed(ctx, feedItem.Url) {
+		return ctx.Err()
+	}
+	defer a.sched.unlockFeed(feedItem.Url)
+
+	data := fetched
+	if data == nil {
+		var err error
+		if data, err = checkValidFeedSource(ctx, feedItem.Url); err != nil {
+			return err
+		}
+	}
+	feedItem.Title = data.Title
+	feedItem.Description = data.Description
+	feedItem.Link = data.Link
+	feedItem.Image = data.Image
+	feedItem.Posts = data.Posts
+
+	job.Fetched = len(feedItem.Posts)
+	job.Published, job.Skipped, job.Failed = 0, 0, 0
+	a.dbUpdateJob(job)
+
+	return a.publishSourceHistory(ctx, feedItem, func(outcome postOutcome) {
+		switch outcome {
+		case postPublished:
+			job.Published++
+		case postSkipped:
+			job.Skipped++
+		case postFailed:
+			job.Failed++
+		case postDeferred:
+			job.Skipped++ // published later by the outbox retrier
+		}
+		a.dbUpdateJob(job)
+	})
+}
+
+// runImportFeedJob adds a feed of an OPML import. Once the feed is stored the
+// job turns into an add-feed job, so a restart doesn't add it twice.
+func (a *Atomstr) runImportFeedJob(ctx context.Context, job *jobStruct) error {
+	settings := feedSettings{}
+	if job.Settings != "" {
+		if err := json.Unmarshal([]byte(job.Settings), &settings); err != nil {
+			return err
+		}
+	}
+	feedItem, err := a.createSource(ctx, job.FeedUrl, settings)
+	if err != nil {
+		return err
+	}
+	job.Kind = jobAddFeed
+	job.FeedUrl = feedItem.Url // the page may have pointed to its feed
+	a.dbUpdateJob(job)
+	return a.runAddFeedJob(ctx, job, feedItem)
+}
+
+// jobColumns is the column list matching scanJob.
+const jobColumns = `id, kind, feed_url, state, fetched, published, skipped, failed, error, created_at, started_at, finished_at, settings`
+
+func scanJob(row rowScanner) (*jobStruct, error) {
+	job := jobStruct{}
+	err := row.Scan(&job.Id, &job.Kind, &job.FeedUrl, &job.State, &job.Fetched, &job.Published, &job.Skipped, &job.Failed, &job.Error, &job.CreatedAt, &job.StartedAt, &job.FinishedAt, &job.Settings)
+	return &job, err
+}
+
+func (a *Atomstr) dbWriteJob(job *jobStruct) bool {
+	sqlStatement := `INSERT INTO jobs (id, kind, feed_url, state, created_at, settings) VALUES (?, ?, ?, ?, ?, ?);`
+	_, err := a.db.Exec(sqlStatement, job.Id, job.Kind, job.FeedUrl, job.State, job.CreatedAt, job.Settings)
+	if err != nil {
+		log.Println("[ERROR] Failed to write job:", err)
+		return false
+	}
+	return true
+}
+
+func (a *Atomstr) dbUpdateJob(job *jobStruct) {
+	sqlStatement := `UPDATE jobs SET kind=?, feed_url=?, state=?, fetched=?, published=?, skipped=?, failed=?, error=?, started_at=?, finished_at=? WHERE id=?;`
+	_, err := a.db.Exec(sqlStatement, job.Kind, job.FeedUrl, job.State, job.Fetched, job.Published, job.Skipped, job.Failed, job.Error, job.StartedAt, job.FinishedAt, job.Id)
+	if err != nil {
+		log.Println("[ERROR] Failed to update job:", err)
+	}
+}
+
+func (a *Atomstr) dbGetJob(id string) (*jobStruct, bool) {
+	row := a.db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id=?;`, id)
+	job, err := scanJob(row)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("[ERROR] Failed to read job:", err)
+		}
+		return nil, false
+	}
+	return job, true
+}
+
+func (a *Atomstr) dbGetJobsByState(state string) []*jobStruct {
+	rows, err := a.db.Query(`SELECT `+jobColumns+` FROM jobs WHERE state=? ORDER BY created_at;`, state)
+	if err != nil {
+		log.Println("[ERROR] Failed to read jobs:", err)
+		return nil
+	}
+	defer rows.Close()
+
+	jobs := []*jobStruct{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			log.Println("[ERROR] Scanning jobs failed:", err)
+			return nil
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func (a *Atomstr) dbRequeueRunningJobs() {
+	res, err := a.db.Exec(`UPDATE jobs SET state=? WHERE state=?;`, jobQueued, jobRunning)
+	if err != nil {
+		log.Println("[ERROR] Failed to requeue jobs:", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[INFO] Requeued %d interrupted jobs\n", n)
+	}
+}
+
+// dbPruneJobs removes finished jobs older than the given duration.
+func (a *Atomstr) dbPruneJobs(olderThan time.Duration) (int64, error) {
+	cutoffTime := time.Now().Add(-olderThan).Unix()
+	sqlStatement := `DELETE FROM jobs WHERE state IN (?, ?) AND finished_at < ?;`
+	result, err := a.db.Exec(sqlStatement, jobDone, jobFailed, cutoffTime)
+	if err != nil {
+		log.Println("[ERROR] Failed to prune jobs:", err)
+		return 0, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	log.Printf("[INFO] Pruned %d jobs older than %v", rowsAffected, olderThan)
+	return rowsAffected, nil
+}
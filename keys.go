@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip49"
+)
+
+// ncryptsecLogN is the scrypt cost of exported ncryptsec keys.
+const ncryptsecLogN = 16
+
+// parseSecretKey reads an nsec, a hex key or, with password, an ncryptsec.
+func parseSecretKey(key, password string) (string, error) {
+	key = strings.TrimSpace(key)
+	switch {
+	case strings.HasPrefix(key, "ncryptsec1"):
+		if password == "" {
+			return "", errors.New("a password is needed for ncryptsec keys")
+		}
+		return nip49.Decrypt(key, password)
+	case strings.HasPrefix(key, "nsec1"):
+		_, value, err := nip19.Decode(key)
+		if err != nil {
+			return "", err
+		}
+		return value.(string), nil
+	case nostr.IsValid32ByteHex(key):
+		return key, nil
+	}
+	return "", errors.New("invalid key, expected nsec, ncryptsec or hex")
+}
+
+// readPassword reads a password from the first line of r.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
+
+// exportKey prints the secret key of a feed as nsec, or as ncryptsec if a
+// password is given.
+func (a *Atomstr) exportKey(w io.Writer, feedUrl, password string) error {
+	feedItem := a.dbGetFeed(feedUrl)
+	if feedItem.Url == "" {
+		log.Println("[WARN] feed not found")
+		return errFeedNotFound
+	}
+	var key string
+	var err error
+	if password != "" {
+		key, err = nip49.Encrypt(feedItem.Sec, password, ncryptsecLogN, nip49.ClientDoesNotTrackThisData)
+	} else {
+		key, err = nip19.EncodePrivateKey(feedItem.Sec)
+	}
+	if err != nil {
+		log.Println("[ERROR] Can't encode key:", err)
+		return err
+	}
+	_, err = fmt.Fprintln(w, key)
+	return err
+}
+
+// feedKeys returns the keys for a new feed: the given secret key, the key the
+// url had before it was deleted or a new one.
+func (a *Atomstr) feedKeys(feedUrl, sec string) (*feedStruct, error) {
+	if sec != "" {
+		pub, err := nostr.GetPublicKey(sec)
+		if err != nil {
+			return nil, err
+		}
+		if existing := a.dbGetFeedByPub(pub); existing.Url != "" {
+			return nil, errors.New("key is already used by " + existing.Url)
+		}
+		return &feedStruct{Url: feedUrl, Pub: pub, Sec: sec}, nil
+	}
+	if archived, ok := a.dbGetArchivedKey(feedUrl); ok {
+		if existing := a.dbGetFeedByPub(archived.Pub); existing.Url == "" {
+			log.Println("[INFO] Restoring the previous key of", feedUrl)
+			return archived, nil
+		}
+	}
+	return generateKeysForUrl(feedUrl), nil
+}
+
+// dbArchiveKey keeps the keys of a deleted feed, so adding the url again
+// restores its identity.
+func (a *Atomstr) dbArchiveKey(feedItem *feedStruct) {
+	sqlStatement := `INSERT OR REPLACE INTO key_archive (url, pub, sec, deleted_at) VALUES (?, ?, ?, ?);`
+	_, err := a.db.Exec(sqlStatement, feedItem.Url, feedItem.Pub, feedItem.Sec, time.Now().Unix())
+	if err != nil {
+		log.Println("[ERROR] Can't archive feed key:", err)
+	}
+}
+
+func (a *Atomstr) dbGetArchivedKey(feedUrl string) (*feedStruct, bool) {
+	feedItem := feedStruct{Url: feedUrl}
+	row := a.db.QueryRow(`SELECT pub, sec FROM key_archive WHERE url=?;`, feedUrl)
+	if err := row.Scan(&feedItem.Pub, &feedItem.Sec); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("[ERROR] Can't read key archive:", err)
+		}
+		return nil, false
+	}
+	return &feedItem, true
+}
+
+func (a *Atomstr) dbDeleteArchivedKey(feedUrl string) {
+	if _, err := a.db.Exec(`DELETE FROM key_archive WHERE url=?;`, feedUrl); err != nil {
+		log.Println("[ERROR] Can't update key archive:", err)
+	}
+}
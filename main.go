@@ -1,72 +1,179 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
-	"sync"
+	"strings"
 	"syscall"
-	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func (a *Atomstr) startWorkers(work string) {
-	feeds := a.dbGetAllFeeds()
-	if len(*feeds) == 0 {
-		log.Println("[WARN] No feeds found")
-	}
-
-	log.Println("[INFO] Start", work)
-
-	ch := make(chan feedStruct)
-	wg := sync.WaitGroup{}
-
-	// start the workers
-	for t := 0; t < maxWorkers; t++ {
-		wg.Add(1)
-		switch work {
-		case "metadata":
-			go a.processFeedMetadata(ch, &wg)
-		case "scrape":
-			go a.processFeedUrl(ch, &wg)
-		default:
-			log.Println("[ERROR] Invalid work type", work)
-			return
-		}
-	}
+// spawn runs fn in a goroutine that is waited for on shutdown.
+func (a *Atomstr) spawn(fn func()) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		fn()
+	}()
+}
 
-	// push the lines to the queue channel for processing
-	for _, feedItem := range *feeds {
-		ch <- feedItem
+// drain waits for all spawned goroutines. It returns false if ctx ends first.
+func (a *Atomstr) drain(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-
-	close(ch) // this will cause the workers to stop and exit their receive loop
-	wg.Wait() // make sure they all exit
-	log.Println("[INFO] Stop", work)
 }
 
 func main() {
-	a := &Atomstr{db: dbInit()}
-
 	logger()
 
 	feedNew := flag.String("a", "", "Add a new URL to scrape")
+	feedKey := flag.String("nsec", "", "Secret key for -a: nsec, hex or ncryptsec (password read from stdin)")
+	keyExport := flag.String("export-key", "", "Print the nsec of a feed")
+	keyEncrypt := flag.Bool("encrypt", false, "With -export-key, print an ncryptsec encrypted with a password read from stdin")
 	feedDelete := flag.String("d", "", "Remove a feed from db")
+	feedPurge := flag.Bool("purge", false, "With -d, also publish deletions of all posts and a blank profile")
+	postDelete := flag.String("delete-post", "", "Publish a deletion for a post, given by link, event ID or note")
+	feedPause := flag.String("pause", "", "Stop fetching a feed without removing it")
+	feedResume := flag.String("resume", "", "Fetch a paused feed, or one disabled after failing, again")
+	flag.StringVar(feedResume, "enable", "", "Alias of -resume")
+	feedUpdate := flag.String("u", "", "Update settings (-relays, -tags, -mode, -dedupe, -interval) of an existing feed")
+	flag.StringVar(feedUpdate, "set-relays", "", "Alias of -u")
+	feedRelays := flag.String("relays", "", "Comma separated publish relays for -a, -u or -import (default RELAYS_TO_PUBLISH_TO)")
+	feedTags := flag.String("tags", "", "Comma separated tags for -a, -u or -import, hooks can select feeds by them")
+	feedMode := flag.String("mode", "", "Publishing mode for -a, -u or -import: note, longform or longform-teaser (default note)")
+	feedDedupe := flag.String("dedupe", "", "Duplicate detection for -a, -u or -import: auto, guid, link or content (default auto)")
+	feedInterval := flag.String("interval", "", "Fetch interval for -a, -u or -import: a duration like 1h, adaptive or default (default FETCH_INTERVAL)")
+	opmlImport := flag.String("import", "", "Import all feeds of an OPML file, takes -relays, -tags, -mode, -dedupe and -interval")
+	opmlExport := flag.String("export", "", "Export all feeds to an OPML file, - for stdout")
 	pruneOlderThan := flag.String("p", "", "Prune published posts older than specified duration (e.g., '30d', '7d', '168h')")
 	flag.Bool("l", false, "List all feeds with npubs")
 	flag.Bool("v", false, "Shows version")
+	flag.Bool("migrations", false, "Show applied and pending database migrations without applying them")
 	flag.Parse()
 	flagset := make(map[string]bool) // map for flag.Visit. get bools to determine set flags
 	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
 
+	if flagset["migrations"] {
+		db := dbOpenReadOnly()
+		listMigrations(db)
+		db.Close()
+		return
+	}
+
+	// cancelled on SIGTERM or SIGINT, all work derives from it
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	a := &Atomstr{db: dbInit(), relays: newRelayPool(context.Background()), jobWake: make(chan struct{}, 1), postPublishQueue: make(chan postPublishTask, postPublishQueueSize), sched: newScheduler()}
+
+	// Load hooks from YAML if available, feeds added from the CLI use them too
+	if cfgPath, err := findDefaultHooksConfig(); err == nil {
+		if cfg, err := loadHooksConfig(cfgPath); err == nil {
+			a.registerHooks(cfg)
+		} else {
+			log.Println("[WARN] Failed to load hooks config:", err)
+		}
+	} else {
+		log.Println("[DEBUG] No hooks config found")
+	}
+
+	var relaysArg, tagsArg, modeArg, dedupeArg, intervalArg *string
+	if flagset["relays"] {
+		relaysArg = feedRelays
+	}
+	if flagset["tags"] {
+		tagsArg = feedTags
+	}
+	if flagset["mode"] {
+		modeArg = feedMode
+	}
+	if flagset["dedupe"] {
+		dedupeArg = feedDedupe
+	}
+	if flagset["interval"] {
+		intervalArg = feedInterval
+	}
+	settings, err := parseFeedSettings(relaysArg, tagsArg, modeArg, dedupeArg, intervalArg)
+	if err != nil {
+		log.Println("[ERROR]", err)
+		return
+	}
+
+	if flagset["nsec"] {
+		if !flagset["a"] {
+			log.Println("[ERROR] -nsec only works with -a")
+			return
+		}
+		var password string
+		if strings.HasPrefix(*feedKey, "ncryptsec1") {
+			if password, err = readPassword(os.Stdin); err != nil {
+				log.Println("[ERROR] Can't read password:", err)
+				return
+			}
+		}
+		if settings.Sec, err = parseSecretKey(*feedKey, password); err != nil {
+			log.Println("[ERROR]", err)
+			return
+		}
+	}
+
 	if flagset["a"] {
-		a.addSource(*feedNew)
+		a.addSource(ctx, *feedNew, settings)
 	} else if flagset["l"] {
 		a.listFeeds()
+	} else if flagset["u"] || flagset["set-relays"] {
+		a.updateFeedSettings(ctx, *feedUpdate, settings)
+	} else if flagset["import"] {
+		f, err := os.Open(*opmlImport)
+		if err != nil {
+			log.Println("[ERROR] Can't open OPML file:", err)
+			return
+		}
+		a.importOPML(ctx, f, settings, logImportProgress)
+		f.Close()
+	} else if flagset["export"] {
+		out := os.Stdout
+		if *opmlExport != "-" {
+			out, err = os.Create(*opmlExport)
+			if err != nil {
+				log.Println("[ERROR] Can't create OPML file:", err)
+				return
+			}
+			defer out.Close()
+		}
+		if err := a.exportOPML(out); err != nil {
+			log.Println("[ERROR] OPML export failed:", err)
+		}
 	} else if flagset["d"] {
-		a.deleteSource(*feedDelete)
+		a.deleteSource(ctx, *feedDelete, *feedPurge)
+	} else if flagset["export-key"] {
+		var password string
+		if *keyEncrypt {
+			if password, err = readPassword(os.Stdin); err != nil {
+				log.Println("[ERROR] Can't read password:", err)
+				return
+			}
+		}
+		a.exportKey(os.Stdout, *keyExport, password)
+	} else if flagset["delete-post"] {
+		a.deletePost(ctx, *postDelete)
+	} else if flagset["pause"] {
+		a.pauseFeed(*feedPause)
+	} else if flagset["resume"] || flagset["enable"] {
+		a.resumeFeed(*feedResume)
 	} else if flagset["p"] {
 		duration, err := parseDurationWithDays(*pruneOlderThan)
 		if err != nil {
@@ -78,71 +185,50 @@ func main() {
 		if err != nil {
 			log.Printf("[ERROR] Pruning failed: %v", err)
 		}
+		_, err = a.dbPruneOutbox(duration)
+		if err != nil {
+			log.Printf("[ERROR] Pruning outbox failed: %v", err)
+		}
+		_, err = a.dbPruneJobs(duration)
+		if err != nil {
+			log.Printf("[ERROR] Pruning jobs failed: %v", err)
+		}
+		_, err = a.dbPruneRuns(duration)
+		if err != nil {
+			log.Printf("[ERROR] Pruning runs failed: %v", err)
+		}
 	} else if flagset["v"] {
 		log.Println("[INFO] atomstr version ", atomstrversion)
 	} else {
 		log.Println("[INFO] Starting atomstr v", atomstrversion)
 		//slog.Info("Starting atomstr v", atomstrversion)
 
-		// Load hooks from YAML if available
-		if cfgPath, err := findDefaultHooksConfig(); err == nil {
-			if cfg, err := loadHooksConfig(cfgPath); err == nil {
-				for _, h := range cfg.Hooks.PrePostNostrPublish {
-					switch h.Type {
-					case "restEnrich":
-						method := h.Method
-						if method == "" {
-							method = "POST"
-						}
-						a.RegisterPrePublishHook(NewRestEnrichHook(h.URL, method, h.Headers, h.ComposeRequest, h.ParseResponse))
-						log.Println("[INFO] Registered prePostNostrPublish hook:", h.Name)
-					case "enrichWithTags":
-						endpoint := h.SuggestTagsURL
-						if endpoint == "" {
-							endpoint = h.URL // allow url alias
-						}
-						a.RegisterPrePublishHook(NewEnrichWithTagsHook(endpoint, h.Headers))
-						log.Println("[INFO] Registered enrichWithTags hook:", h.Name)
-					}
-				}
-			} else {
-				log.Println("[WARN] Failed to load hooks config:", err)
-			}
-		} else {
-			log.Println("[DEBUG] No hooks config found")
-		}
-
-		go a.webserver()
-
-		// first run
-		a.startWorkers("metadata")
-		a.startWorkers("scrape")
+		srv := a.webserver(ctx)
+		a.spawn(func() { a.outboxRetrier(ctx) })
+		a.spawn(func() { a.jobRunner(ctx) })
 
-		metadataTicker := time.NewTicker(metadataInterval)
-		updateTicker := time.NewTicker(fetchInterval)
+		a.dbInterruptRuns()
+		a.spawn(func() { a.schedule(ctx) })
 
-		cancelChan := make(chan os.Signal, 1)
-		// catch SIGETRM or SIGINTERRUPT
-		signal.Notify(cancelChan, syscall.SIGTERM, syscall.SIGINT)
-
-		go func() {
-			for {
-				select {
-				case <-metadataTicker.C:
-					a.startWorkers("metadata")
-				case <-updateTicker.C:
-					a.startWorkers("scrape")
-				}
-			}
-		}()
-		sig := <-cancelChan
+		<-ctx.Done()
+		stop() // a second signal kills right away
+		log.Println("[INFO] Caught signal, shutting down within", shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
 
-		log.Printf("[DEBUG] Caught signal %v", sig)
-		metadataTicker.Stop()
-		updateTicker.Stop()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Println("[WARN] Webserver did not shut down cleanly:", err)
+		}
+		if !a.drain(shutdownCtx) {
+			log.Println("[WARN] Shutdown deadline exceeded, some work was still running")
+		}
+		log.Println("[INFO] Closing relay connections")
+		a.relays.close()
 		log.Println("[INFO] Closing DB")
 		a.db.Close()
 		log.Println("[INFO] Shutting down")
-
+		return
 	}
+	// CLI commands wait for background work like post-publish hooks
+	a.drain(ctx)
 }
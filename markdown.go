@@ -0,0 +1,171 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var regBlankLines = regexp.MustCompile(`\n{3,}`)
+
+// htmlToMarkdown converts the HTML body of a feed item into Markdown for
+// NIP-23 long-form content. Unknown elements are reduced to their text.
+func htmlToMarkdown(content string) string {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return content
+	}
+	var sb strings.Builder
+	mdWalk(&sb, doc, &mdState{})
+	out := regBlankLines.ReplaceAllString(sb.String(), "\n\n")
+	return strings.TrimSpace(out)
+}
+
+type mdState struct {
+	lists []int // item counter per nested list, -1 for unordered
+	pre   bool
+}
+
+func mdWalk(sb *strings.Builder, n *html.Node, st *mdState) {
+	switch n.Type {
+	case html.TextNode:
+		text := n.Data
+		if !st.pre {
+			text = strings.Join(strings.Fields(text), " ")
+			if strings.HasPrefix(n.Data, " ") || strings.HasPrefix(n.Data, "\n") {
+				text = " " + text
+			}
+			if len(n.Data) > 1 && (strings.HasSuffix(n.Data, " ") || strings.HasSuffix(n.Data, "\n")) {
+				text = text + " "
+			}
+		}
+		sb.WriteString(text)
+		return
+	case html.ElementNode:
+	default:
+		mdChildren(sb, n, st)
+		return
+	}
+
+	switch n.Data {
+	case "script", "style", "iframe", "noscript":
+		return
+	case "p", "div", "section", "article", "figure":
+		mdBlock(sb)
+		mdChildren(sb, n, st)
+		mdBlock(sb)
+	case "br":
+		sb.WriteString("  \n")
+	case "hr":
+		mdBlock(sb)
+		sb.WriteString("---")
+		mdBlock(sb)
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		level, _ := strconv.Atoi(n.Data[1:])
+		mdBlock(sb)
+		sb.WriteString(strings.Repeat("#", level) + " ")
+		mdChildren(sb, n, st)
+		mdBlock(sb)
+	case "strong", "b":
+		sb.WriteString("**")
+		mdChildren(sb, n, st)
+		sb.WriteString("**")
+	case "em", "i":
+		sb.WriteString("_")
+		mdChildren(sb, n, st)
+		sb.WriteString("_")
+	case "code":
+		if st.pre {
+			mdChildren(sb, n, st)
+			return
+		}
+		sb.WriteString("`")
+		mdChildren(sb, n, st)
+		sb.WriteString("`")
+	case "pre":
+		mdBlock(sb)
+		sb.WriteString("```\n")
+		st.pre = true
+		mdChildren(sb, n, st)
+		st.pre = false
+		sb.WriteString("\n```")
+		mdBlock(sb)
+	case "blockquote":
+		var inner strings.Builder
+		mdChildren(&inner, n, st)
+		quote := strings.TrimSpace(regBlankLines.ReplaceAllString(inner.String(), "\n\n"))
+		mdBlock(sb)
+		for i, line := range strings.Split(quote, "\n") {
+			if i > 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(strings.TrimRight("> "+line, " "))
+		}
+		mdBlock(sb)
+	case "a":
+		href := mdAttr(n, "href")
+		if href == "" {
+			mdChildren(sb, n, st)
+			return
+		}
+		sb.WriteString("[")
+		mdChildren(sb, n, st)
+		sb.WriteString("](" + href + ")")
+	case "img":
+		src := mdAttr(n, "src")
+		if src != "" {
+			sb.WriteString("![" + mdAttr(n, "alt") + "](" + src + ")")
+		}
+	case "ul", "ol":
+		mdBlock(sb)
+		counter := -1
+		if n.Data == "ol" {
+			counter = 0
+		}
+		st.lists = append(st.lists, counter)
+		mdChildren(sb, n, st)
+		st.lists = st.lists[:len(st.lists)-1]
+		mdBlock(sb)
+	case "li":
+		depth := len(st.lists)
+		if depth == 0 {
+			mdChildren(sb, n, st)
+			return
+		}
+		sb.WriteString("\n" + strings.Repeat("  ", depth-1))
+		if st.lists[depth-1] >= 0 {
+			st.lists[depth-1]++
+			sb.WriteString(strconv.Itoa(st.lists[depth-1]) + ". ")
+		} else {
+			sb.WriteString("- ")
+		}
+		mdChildren(sb, n, st)
+	default:
+		mdChildren(sb, n, st)
+	}
+}
+
+func mdChildren(sb *strings.Builder, n *html.Node, st *mdState) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		mdWalk(sb, c, st)
+	}
+}
+
+// mdBlock separates block elements by an empty line.
+func mdBlock(sb *strings.Builder) {
+	if sb.Len() == 0 {
+		return
+	}
+	sb.WriteString("\n\n")
+}
+
+func mdAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestHtmlToMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"plain text", "Hello world", "Hello world"},
+		{"paragraphs", "<p>One</p><p>Two</p>", "One\n\nTwo"},
+		{"whitespace collapsed", "<p>  lots\n\n of   space </p>", "lots of space"},
+		{"headings", "<h1>Title</h1><h3>Sub</h3>", "# Title\n\n### Sub"},
+		{"emphasis", "<p><strong>bold</strong> and <em>italic</em></p>", "**bold** and _italic_"},
+		{"inline code", "<p>run <code>go test</code></p>", "run `go test`"},
+		{"code block keeps whitespace", "<pre><code>a  b\n  c</code></pre>", "```\na  b\n  c\n```"},
+		{"link", `<a href="https://example.com">site</a>`, "[site](https://example.com)"},
+		{"link without href", "<a>text</a>", "text"},
+		{"image", `<img src="https://example.com/a.png" alt="A">`, "![A](https://example.com/a.png)"},
+		{"image without src", `<img alt="A">`, ""},
+		{"unordered list", "<ul><li>a</li><li>b</li></ul>", "- a\n- b"},
+		{"ordered list", "<ol><li>a</li><li>b</li></ol>", "1. a\n2. b"},
+		{"nested list", "<ul><li>a<ul><li>b</li></ul></li></ul>", "- a\n\n  - b"},
+		{"blockquote", "<blockquote><p>One</p><p>Two</p></blockquote>", "> One\n>\n> Two"},
+		{"line break", "a<br>b", "a  \nb"},
+		{"rule", "<p>a</p><hr><p>b</p>", "a\n\n---\n\nb"},
+		{"scripts dropped", "<p>a</p><script>alert(1)</script><style>p{}</style>", "a"},
+		{"unknown elements reduced to text", "<span>a <mark>b</mark></span>", "a b"},
+		{"blank lines squashed", "<div><p>a</p></div><div><p>b</p></div>", "a\n\nb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlToMarkdown(tt.html); got != tt.want {
+				t.Errorf("htmlToMarkdown(%q) = %q, want %q", tt.html, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one step of the database schema. Either sql or fn is set.
+// Migrations are applied in order, each in its own transaction, and recorded
+// in schema_version. Never change a released migration, append a new one.
+type migration struct {
+	version int
+	name    string
+	sql     string
+	fn      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{version: 1, name: "initial schema", sql: `
+CREATE TABLE IF NOT EXISTS feeds (
+	pub VARCHAR(64) PRIMARY KEY,
+	sec VARCHAR(64) NOT NULL,
+	url TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS published_posts (
+	url TEXT PRIMARY KEY,
+	feed_url TEXT NOT NULL,
+	published_at INTEGER NOT NULL,
+	nostr_event_id TEXT NOT NULL,
+	FOREIGN KEY (feed_url) REFERENCES feeds(url)
+);
+CREATE INDEX IF NOT EXISTS idx_published_posts_feed_url ON published_posts(feed_url);
+CREATE INDEX IF NOT EXISTS idx_published_posts_published_at ON published_posts(published_at);
+CREATE INDEX IF NOT EXISTS idx_published_posts_nostr_event_id ON published_posts(nostr_event_id);
+`},
+	{version: 2, name: "feed fetch cache", sql: `
+CREATE TABLE IF NOT EXISTS feed_cache (
+	url TEXT NOT NULL,
+	work TEXT NOT NULL,
+	etag TEXT NOT NULL DEFAULT '',
+	last_modified TEXT NOT NULL DEFAULT '',
+	body_hash TEXT NOT NULL DEFAULT '',
+	fetched_at INTEGER NOT NULL,
+	PRIMARY KEY (url, work)
+);
+`},
+	{version: 3, name: "relay outbox", sql: `
+CREATE TABLE IF NOT EXISTS outbox (
+	event_id TEXT NOT NULL,
+	relay TEXT NOT NULL,
+	event TEXT NOT NULL,
+	feed_url TEXT NOT NULL,
+	state TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	next_attempt_at INTEGER NOT NULL,
+	PRIMARY KEY (event_id, relay)
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_state_next_attempt ON outbox(state, next_attempt_at);
+`},
+	{version: 4, name: "per-feed publish relays", fn: addColumn("feeds", "relays", "TEXT NOT NULL DEFAULT ''")},
+	{version: 5, name: "feed publishing mode", fn: addColumn("feeds", "mode", "TEXT NOT NULL DEFAULT 'note'")},
+	{version: 6, name: "feed dedupe strategy", fn: addColumn("feeds", "dedupe", "TEXT NOT NULL DEFAULT 'auto'")},
+	{version: 7, name: "published post identities", fn: migratePublishedPostIdentities},
+	{version: 8, name: "background jobs", sql: `
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	kind TEXT NOT NULL,
+	feed_url TEXT NOT NULL,
+	state TEXT NOT NULL,
+	fetched INTEGER NOT NULL DEFAULT 0,
+	published INTEGER NOT NULL DEFAULT 0,
+	skipped INTEGER NOT NULL DEFAULT 0,
+	failed INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	started_at INTEGER NOT NULL DEFAULT 0,
+	finished_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_jobs_state ON jobs(state);
+`},
+	{version: 9, name: "scheduler runs", sql: `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	work TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	finished_at INTEGER NOT NULL DEFAULT 0,
+	outcome TEXT NOT NULL,
+	feeds INTEGER NOT NULL DEFAULT 0,
+	failed INTEGER NOT NULL DEFAULT 0,
+	skipped INTEGER NOT NULL DEFAULT 0
+);
+`},
+	{version: 10, name: "per-feed fetch intervals", fn: func(tx *sql.Tx) error {
+		for _, step := range []func(tx *sql.Tx) error{
+			addColumn("feeds", "interval", "TEXT NOT NULL DEFAULT ''"),
+			addColumn("feeds", "post_interval", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("feeds", "next_fetch_at", "INTEGER NOT NULL DEFAULT 0"),
+		} {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{version: 11, name: "feed health", fn: func(tx *sql.Tx) error {
+		for _, step := range []func(tx *sql.Tx) error{
+			addColumn("feeds", "state", "TEXT NOT NULL DEFAULT 'active'"),
+			addColumn("feeds", "error_count", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("feeds", "last_error", "TEXT NOT NULL DEFAULT ''"),
+			addColumn("feeds", "failing_since", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("feeds", "last_success_at", "INTEGER NOT NULL DEFAULT 0"),
+		} {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{version: 12, name: "deleted posts", fn: addColumn("published_posts", "deleted_at", "INTEGER NOT NULL DEFAULT 0")},
+	{version: 13, name: "key archive", sql: `
+CREATE TABLE IF NOT EXISTS key_archive (
+	url TEXT PRIMARY KEY,
+	pub VARCHAR(64) NOT NULL,
+	sec VARCHAR(64) NOT NULL,
+	deleted_at INTEGER NOT NULL
+);
+`},
+	{version: 14, name: "deferred posts", sql: `
+CREATE TABLE IF NOT EXISTS deferred_posts (
+	feed_url TEXT NOT NULL,
+	post_key TEXT NOT NULL,
+	item TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	next_attempt_at INTEGER NOT NULL,
+	PRIMARY KEY (feed_url, post_key)
+);
+CREATE INDEX IF NOT EXISTS idx_deferred_posts_next_attempt_at ON deferred_posts(next_attempt_at);
+`},
+	{version: 15, name: "job settings", fn: addColumn("jobs", "settings", "TEXT NOT NULL DEFAULT ''")},
+	{version: 16, name: "article references", fn: func(tx *sql.Tx) error {
+		for _, step := range []func(tx *sql.Tx) error{
+			addColumn("published_posts", "article_d", "TEXT NOT NULL DEFAULT ''"),
+			addColumn("published_posts", "teaser_event_id", "TEXT NOT NULL DEFAULT ''"),
+		} {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{version: 17, name: "feed tags", fn: addColumn("feeds", "tags", "TEXT NOT NULL DEFAULT ''")},
+}
+
+const sqlSchemaVersion = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at INTEGER NOT NULL
+);
+`
+
+// dbSchemaVersion returns the highest applied migration, 0 for a database
+// without schema_version. It doesn't write to the database.
+func dbSchemaVersion(db *sql.DB) (int, error) {
+	var tables int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='schema_version'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// pendingMigrations returns all migrations newer than the database schema.
+func pendingMigrations(db *sql.DB) ([]migration, error) {
+	version, err := dbSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	pending := []migration{}
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// dbMigrate applies all pending migrations.
+func dbMigrate(db *sql.DB) error {
+	if _, err := db.Exec(sqlSchemaVersion); err != nil {
+		return err
+	}
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		log.Printf("[INFO] Applying migration %d: %s", m.version, m.name)
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.sql != "" {
+		if _, err := tx.Exec(m.sql); err != nil {
+			return err
+		}
+	}
+	if m.fn != nil {
+		if err := m.fn(tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`, m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// listMigrations prints applied and pending migrations without applying them.
+func listMigrations(db *sql.DB) {
+	version, err := dbSchemaVersion(db)
+	if err != nil {
+		log.Println("[ERROR] Can't read schema version:", err)
+		return
+	}
+	fmt.Println("Schema version:", version)
+	pending := 0
+	for _, m := range migrations {
+		state := "applied"
+		if m.version > version {
+			state = "pending"
+			pending++
+		}
+		fmt.Printf("%3d %-8s %s\n", m.version, state, m.name)
+	}
+	fmt.Printf("%d pending migration(s)\n", pending)
+}
+
+// txHasColumn reports whether a table has the given column.
+func txHasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// addColumn returns a migration step adding a column unless it already exists.
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		exists, err := txHasColumn(tx, table, column)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+		return err
+	}
+}
+
+// migratePublishedPostIdentities rebuilds published_posts from the link keyed
+// layout to one row per post identity, see postIdentity. Links of old rows
+// are normalized so they keep matching after tracking parameters change.
+func migratePublishedPostIdentities(tx *sql.Tx) error {
+	exists, err := txHasColumn(tx, "published_posts", "guid")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.Exec(`
+ALTER TABLE published_posts RENAME TO published_posts_old;
+DROP INDEX IF EXISTS idx_published_posts_feed_url;
+DROP INDEX IF EXISTS idx_published_posts_published_at;
+DROP INDEX IF EXISTS idx_published_posts_nostr_event_id;
+CREATE TABLE published_posts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	url TEXT NOT NULL,
+	feed_url TEXT NOT NULL,
+	guid TEXT NOT NULL DEFAULT '',
+	normalized_url TEXT NOT NULL DEFAULT '',
+	content_hash TEXT NOT NULL DEFAULT '',
+	published_at INTEGER NOT NULL,
+	nostr_event_id TEXT NOT NULL,
+	FOREIGN KEY (feed_url) REFERENCES feeds(url)
+);
+INSERT INTO published_posts (url, feed_url, published_at, nostr_event_id)
+	SELECT url, feed_url, published_at, nostr_event_id FROM published_posts_old;
+DROP TABLE published_posts_old;`)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`SELECT id, url FROM published_posts`)
+		if err != nil {
+			return err
+		}
+		normalized := map[int64]string{}
+		for rows.Next() {
+			var id int64
+			var link string
+			if err := rows.Scan(&id, &link); err != nil {
+				rows.Close()
+				return err
+			}
+			normalized[id] = normalizeLink(link)
+		}
+		rows.Close()
+		for id, link := range normalized {
+			if _, err := tx.Exec(`UPDATE published_posts SET normalized_url=? WHERE id=?`, link, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(`
+CREATE INDEX IF NOT EXISTS idx_published_posts_url ON published_posts(url);
+CREATE INDEX IF NOT EXISTS idx_published_posts_feed_url_guid ON published_posts(feed_url, guid);
+CREATE INDEX IF NOT EXISTS idx_published_posts_feed_url_normalized_url ON published_posts(feed_url, normalized_url);
+CREATE INDEX IF NOT EXISTS idx_published_posts_feed_url_content_hash ON published_posts(feed_url, content_hash);
+CREATE INDEX IF NOT EXISTS idx_published_posts_published_at ON published_posts(published_at);
+CREATE INDEX IF NOT EXISTS idx_published_posts_nostr_event_id ON published_posts(nostr_event_id);
+`)
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB opens an empty SQLite database in a temporary directory.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "atomstr.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// migrateTestDBTo applies the migrations up to and including version.
+func migrateTestDBTo(t *testing.T, db *sql.DB, version int) {
+	t.Helper()
+	if _, err := db.Exec(sqlSchemaVersion); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.version > version {
+			break
+		}
+		if err := applyMigration(db, m); err != nil {
+			t.Fatalf("migration %d: %v", m.version, err)
+		}
+	}
+}
+
+func TestDbMigrate(t *testing.T) {
+	db := openTestDB(t)
+	if err := dbMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbMigrate(db); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	version, err := dbSchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := migrations[len(migrations)-1].version; version != want {
+		t.Errorf("schema version = %d, want %d", version, want)
+	}
+}
+
+func TestMigratePublishedPostIdentities(t *testing.T) {
+	db := openTestDB(t)
+	migrateTestDBTo(t, db, 6)
+
+	legacy := map[string]string{
+		"https://example.com/a?utm_source=rss": "https://example.com/a",
+		"HTTPS://Example.com/b#comments":       "https://example.com/b",
+		"https://example.com/c?id=3&fbclid=x":  "https://example.com/c?id=3",
+	}
+	for link := range legacy {
+		_, err := db.Exec(`INSERT INTO published_posts (url, feed_url, published_at, nostr_event_id) VALUES (?, ?, ?, ?)`,
+			link, "https://example.com/feed", 1, "event-"+link)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dbMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(`SELECT url, guid, normalized_url, content_hash, nostr_event_id FROM published_posts`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	seen := 0
+	for rows.Next() {
+		var link, guid, normalized, hash, eventId string
+		if err := rows.Scan(&link, &guid, &normalized, &hash, &eventId); err != nil {
+			t.Fatal(err)
+		}
+		seen++
+		want, ok := legacy[link]
+		if !ok {
+			t.Errorf("unexpected row %q", link)
+			continue
+		}
+		if normalized != want {
+			t.Errorf("normalized_url of %q = %q, want %q", link, normalized, want)
+		}
+		if guid != "" || hash != "" {
+			t.Errorf("row %q got guid %q and content hash %q, want both empty", link, guid, hash)
+		}
+		if eventId != "event-"+link {
+			t.Errorf("nostr_event_id of %q = %q", link, eventId)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(legacy) {
+		t.Errorf("got %d rows, want %d", seen, len(legacy))
+	}
+}
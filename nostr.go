@@ -3,14 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
-	"sync"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
-func nostrUpdateFeedMetadata(feedItem *feedStruct) {
+func (a *Atomstr) nostrUpdateFeedMetadata(ctx context.Context, feedItem *feedStruct) {
 	//fmt.Println(feedItem)
 
 	metadata := map[string]string{
@@ -29,38 +29,83 @@ func nostrUpdateFeedMetadata(feedItem *feedStruct) {
 		Tags:      nostr.Tags{},
 		Content:   string(content),
 	}
-	ev.ID = string(ev.Serialize())
+
+	// Run profile hooks before signing
+	if updated, err := a.runPreProfilePublishHooks(ctx, *feedItem, &ev); err != nil {
+		log.Println("[ERROR] profile hooks aborted metadata update:", err)
+		return
+	} else if updated != nil {
+		ev = *updated
+	}
+
 	ev.Sign(feedItem.Sec)
 	log.Println("[DEBUG] Updating feed metadata for", feedItem.Title)
 
 	if !noPub {
-		publishedCount, errCount := nostrPostItem(ev)
+		publishedCount, errCount := a.nostrPostItem(ctx, ev, feedItem.publishRelays())
 		log.Printf("[DEBUG] Published feed metadata to %d / %d relays\n", publishedCount, errCount+publishedCount)
+		a.nostrUpdateFeedRelayList(ctx, feedItem)
 	}
 }
 
-func (a *Atomstr) processFeedMetadata(ch chan feedStruct, wg *sync.WaitGroup) {
-	for feedItem := range ch {
-		data, err := checkValidFeedSource(feedItem.Url)
-		if err != nil {
-			log.Println("[ERROR] error updating feed")
-			continue
-		}
-		feedItem.Title = data.Title
-		feedItem.Description = data.Description
-		feedItem.Link = data.Link
-		feedItem.Image = data.Image
-		nostrUpdateFeedMetadata(&feedItem)
+// nostrUpdateFeedRelayList publishes a NIP-65 relay list so clients know
+// where to find the posts of a feed.
+func (a *Atomstr) nostrUpdateFeedRelayList(ctx context.Context, feedItem *feedStruct) {
+	relays := feedItem.publishRelays()
+	tags := nostr.Tags{}
+	for _, url := range relays {
+		tags = append(tags, nostr.Tag{"r", url})
 	}
-	wg.Done()
+
+	ev := nostr.Event{
+		PubKey:    feedItem.Pub,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindRelayListMetadata,
+		Tags:      tags,
+		Content:   "",
+	}
+	ev.Sign(feedItem.Sec)
+
+	publishedCount, errCount := a.nostrPostItem(ctx, ev, relays)
+	log.Printf("[DEBUG] Published feed relay list to %d / %d relays\n", publishedCount, errCount+publishedCount)
 }
 
-func (a *Atomstr) ALTnostrUpdateAllFeedsMetadata() {
+// processFeedMetadata republishes the profile of a feed if the feed changed.
+func (a *Atomstr) processFeedMetadata(ctx context.Context, feedItem feedStruct) error {
+	hostCtx, release, err := acquireHostSlot(ctx, feedItem.Url)
+	if err != nil {
+		return err
+	}
+	fetchCtx, cancel := context.WithTimeout(hostCtx, 10*time.Second)
+	feed, cache, err := a.fetchFeed(fetchCtx, feedItem.Url, "metadata")
+	cancel()
+	release()
+	if errors.Is(err, errFeedNotModified) {
+		log.Println("[DEBUG] Feed metadata not modified", feedItem.Url)
+		return nil
+	} else if err != nil {
+		log.Println("[ERROR] error updating feed")
+		return err
+	}
+	data := feedStructFromFeed(feedItem.Url, feed)
+	feedItem.Title = data.Title
+	feedItem.Description = data.Description
+	feedItem.Link = data.Link
+	feedItem.Image = data.Image
+	a.nostrUpdateFeedMetadata(ctx, &feedItem)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	a.dbWriteFeedCache(cache)
+	return nil
+}
+
+func (a *Atomstr) ALTnostrUpdateAllFeedsMetadata(ctx context.Context) {
 	feeds := a.dbGetAllFeeds()
 
 	log.Println("[INFO] Updating feeds metadata")
 	for _, feedItem := range *feeds {
-		data, err := checkValidFeedSource(feedItem.Url)
+		data, err := checkValidFeedSource(ctx, feedItem.Url)
 		//if data.Title == "" {
 		if err != nil {
 			log.Println("[ERROR] error updating feed")
@@ -70,40 +115,15 @@ func (a *Atomstr) ALTnostrUpdateAllFeedsMetadata() {
 		feedItem.Description = data.Description
 		feedItem.Link = data.Link
 		feedItem.Image = data.Image
-		nostrUpdateFeedMetadata(&feedItem)
+		a.nostrUpdateFeedMetadata(ctx, &feedItem)
 	}
 	log.Println("[INFO] Finished updating feeds metadata")
 }
 
-func nostrPostItem(ev nostr.Event) (int, int) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// nostrPostItem publishes an event through the shared relay pool.
+func (a *Atomstr) nostrPostItem(ctx context.Context, ev nostr.Event, relays []string) (int, int) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	successCount := 0
-	errCount := 0
-	for _, url := range relaysToPublishTo {
-		relay, err := nostr.RelayConnect(ctx, url)
-		if err != nil {
-			log.Println("[ERROR]", err)
-			errCount++
-			continue
-		}
-		err = relay.Publish(ctx, ev)
-		if err != nil {
-			log.Println("[ERROR]", err)
-			errCount++
-			continue
-		}
-
-		err = relay.Close()
-		if err != nil {
-			log.Println("[ERROR]", err)
-			errCount++
-			continue
-		}
-
-		log.Printf("[DEBUG] Event published to %s\n", url)
-		successCount++
-	}
-	return successCount, errCount
+	return a.relays.publish(ctx, relays, ev)
 }
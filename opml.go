@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+type opmlDocument struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    opmlHead `xml:"head"`
+	Body    opmlBody `xml:"body"`
+}
+
+type opmlBody struct {
+	Outline []opmlEntry `xml:"outline"`
+}
+
+type opmlHead struct {
+	Title       string `xml:"title,omitempty"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+// opmlEntry is a feed or a folder of feeds. The npub attribute is our own
+// extension, other readers ignore it.
+type opmlEntry struct {
+	Text    string      `xml:"text,attr"`
+	Title   string      `xml:"title,attr,omitempty"`
+	Type    string      `xml:"type,attr,omitempty"`
+	XmlUrl  string      `xml:"xmlUrl,attr,omitempty"`
+	HtmlUrl string      `xml:"htmlUrl,attr,omitempty"`
+	Npub    string      `xml:"npub,attr,omitempty"`
+	Outline []opmlEntry `xml:"outline"`
+}
+
+// opmlImportResult counts what happened to the feeds of an import.
+type opmlImportResult struct {
+	Added   int
+	Skipped int
+	Failed  int
+}
+
+// parseOPML returns the feed urls of all outlines, including nested ones.
+func parseOPML(r io.Reader) ([]string, error) {
+	var doc opmlDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	urls := []string{}
+	seen := map[string]bool{}
+	var walk func(entries []opmlEntry)
+	walk = func(entries []opmlEntry) {
+		for _, entry := range entries {
+			feedUrl := strings.TrimSpace(entry.XmlUrl)
+			if feedUrl != "" && !seen[feedUrl] {
+				seen[feedUrl] = true
+				urls = append(urls, feedUrl)
+			}
+			walk(entry.Outline)
+		}
+	}
+	walk(doc.Body.Outline)
+	return urls, nil
+}
+
+// importOPML adds every feed of an OPML file with the given settings. Feeds
+// already in the db are skipped. progress is called after each feed.
+func (a *Atomstr) importOPML(ctx context.Context, r io.Reader, settings feedSettings, progress func(done, total int, feedUrl string, err error)) (opmlImportResult, error) {
+	result := opmlImportResult{}
+	urls, err := parseOPML(r)
+	if err != nil {
+		log.Println("[ERROR] Can't parse OPML:", err)
+		return result, err
+	}
+	if len(urls) == 0 {
+		return result, errors.New("no feeds found in OPML")
+	}
+
+	for i, feedUrl := range urls {
+		if ctx.Err() != nil {
+			log.Printf("[WARN] OPML import interrupted after %d of %d feeds\n", i, len(urls))
+			return result, ctx.Err()
+		}
+		if a.dbGetFeed(feedUrl).Url != "" {
+			err = errFeedExists
+		} else {
+			_, err = a.addSource(ctx, feedUrl, settings)
+		}
+		switch {
+		case errors.Is(err, errFeedExists):
+			result.Skipped++
+		case err != nil:
+			result.Failed++
+		default:
+			result.Added++
+		}
+		if progress != nil {
+			progress(i+1, len(urls), feedUrl, err)
+		}
+	}
+	log.Printf("[INFO] OPML import finished: %d added, %d skipped, %d failed\n", result.Added, result.Skipped, result.Failed)
+	return result, nil
+}
+
+// queueOPMLImport queues an import-feed job for every new feed of an OPML
+// file and returns right away. Feeds already in the db are skipped.
+func (a *Atomstr) queueOPMLImport(r io.Reader, settings feedSettings) ([]*jobStruct, int, error) {
+	urls, err := parseOPML(r)
+	if err != nil {
+		log.Println("[ERROR] Can't parse OPML:", err)
+		return nil, 0, err
+	}
+	if len(urls) == 0 {
+		return nil, 0, errors.New("no feeds found in OPML")
+	}
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	jobs := []*jobStruct{}
+	skipped := 0
+	for _, feedUrl := range urls {
+		if a.dbGetFeed(feedUrl).Url != "" {
+			skipped++
+			continue
+		}
+		job := &jobStruct{
+			Id:        newJobId(),
+			Kind:      jobImportFeed,
+			FeedUrl:   feedUrl,
+			State:     jobQueued,
+			CreatedAt: time.Now().Unix(),
+			Settings:  string(settingsJSON),
+		}
+		if !a.dbWriteJob(job) {
+			return jobs, skipped, errors.New("can't queue job")
+		}
+		jobs = append(jobs, job)
+	}
+	log.Printf("[INFO] OPML import queued %d jobs, skipped %d existing feeds\n", len(jobs), skipped)
+	a.wakeJobRunner()
+	return jobs, skipped, nil
+}
+
+// logImportProgress reports the import progress on the command line.
+func logImportProgress(done, total int, feedUrl string, err error) {
+	switch {
+	case errors.Is(err, errFeedExists):
+		log.Printf("[INFO] [%d/%d] Skipped existing feed %s\n", done, total, feedUrl)
+	case err != nil:
+		log.Printf("[WARN] [%d/%d] Failed to add %s: %v\n", done, total, feedUrl, err)
+	default:
+		log.Printf("[INFO] [%d/%d] Added %s\n", done, total, feedUrl)
+	}
+}
+
+// exportOPML writes all feeds as an OPML subscription list.
+func (a *Atomstr) exportOPML(w io.Writer) error {
+	doc := opmlDocument{
+		Version: "2.0",
+		Head: opmlHead{
+			Title:       "atomstr feeds",
+			DateCreated: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, feedItem := range *a.dbGetAllFeeds() {
+		doc.Body.Outline = append(doc.Body.Outline, opmlEntry{
+			Text:   feedItem.Url,
+			Type:   "rss",
+			XmlUrl: feedItem.Url,
+			Npub:   feedItem.Npub,
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseOPML(t *testing.T) {
+	tests := []struct {
+		name    string
+		opml    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "flat",
+			opml: `<opml version="2.0"><body>
+				<outline text="A" type="rss" xmlUrl="https://a.example/feed"/>
+				<outline text="B" type="rss" xmlUrl="https://b.example/rss"/>
+			</body></opml>`,
+			want: []string{"https://a.example/feed", "https://b.example/rss"},
+		},
+		{
+			name: "nested folders",
+			opml: `<opml version="1.0"><body>
+				<outline text="Tech">
+					<outline text="A" xmlUrl="https://a.example/feed"/>
+					<outline text="Deep"><outline text="C" xmlUrl="https://c.example/atom"/></outline>
+				</outline>
+				<outline text="B" xmlUrl="https://b.example/rss"/>
+			</body></opml>`,
+			want: []string{"https://a.example/feed", "https://c.example/atom", "https://b.example/rss"},
+		},
+		{
+			name: "duplicates and blanks skipped",
+			opml: `<opml version="2.0"><body>
+				<outline text="A" xmlUrl=" https://a.example/feed "/>
+				<outline text="Folder"><outline text="A again" xmlUrl="https://a.example/feed"/></outline>
+				<outline text="No url" htmlUrl="https://d.example/"/>
+			</body></opml>`,
+			want: []string{"https://a.example/feed"},
+		},
+		{
+			name: "empty body",
+			opml: `<opml version="2.0"><head><title>x</title></head><body></body></opml>`,
+			want: []string{},
+		},
+		{
+			name:    "not xml",
+			opml:    `{"feeds": []}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOPML(strings.NewReader(tt.opml))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOPML() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.want) {
+				t.Errorf("parseOPML() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
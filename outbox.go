@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+)
+
+var outboxBackoffMin = time.Minute
+var outboxBackoffMax = 6 * time.Hour
+
+// outboxEntry is the delivery state of one signed event for one relay.
+type outboxEntry struct {
+	EventId   string
+	Relay     string
+	Event     nostr.Event
+	FeedUrl   string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// relayResult is the outcome of delivering an event to one relay.
+type relayResult struct {
+	Relay string `json:"relay"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// nostrPublishDurable stores a signed event in the outbox for every relay,
+// tries to deliver it right away and leaves failed deliveries to the retrier.
+// It returns the number of relays that accepted and rejected the first attempt.
+func (a *Atomstr) nostrPublishDurable(ctx context.Context, ev nostr.Event, feedUrl string, relays []string) (int, int) {
+	successCount := 0
+	errCount := 0
+	results, _ := a.nostrPublishDurableResults(ctx, ev, feedUrl, relays)
+	for _, result := range results {
+		if result.Ok {
+			successCount++
+		} else {
+			errCount++
+		}
+	}
+	return successCount, errCount
+}
+
+// nostrPublishDurableResults is nostrPublishDurable returning the result of
+// the first attempt per relay. queued is false if the event could not be
+// stored in the outbox, failed relays are then not retried.
+func (a *Atomstr) nostrPublishDurableResults(ctx context.Context, ev nostr.Event, feedUrl string, relays []string) (results []relayResult, queued bool) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var deliveries []func() (string, error)
+	queued = a.dbEnqueueOutbox(ev, feedUrl, relays)
+	if queued {
+		for _, entry := range a.dbGetOutboxEntries(ev.ID) {
+			deliveries = append(deliveries, func() (string, error) {
+				return entry.Relay, a.deliverOutboxEntry(ctx, entry)
+			})
+		}
+	} else {
+		// fall back to a plain publish so the event is not lost entirely
+		for _, relay := range relays {
+			deliveries = append(deliveries, func() (string, error) {
+				return relay, a.relays.publishTo(ctx, relay, ev)
+			})
+		}
+	}
+
+	var mu sync.Mutex
+	wg := sync.WaitGroup{}
+	results = []relayResult{}
+	for _, deliver := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			relay, err := deliver()
+			result := relayResult{Relay: relay, Ok: err == nil}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, result)
+		}()
+	}
+	wg.Wait()
+	return results, queued
+}
+
+// deliverOutboxEntry publishes a single outbox entry and updates its state.
+func (a *Atomstr) deliverOutboxEntry(ctx context.Context, entry outboxEntry) error {
+	err := a.relays.publishTo(ctx, entry.Relay, entry.Event)
+	if err == nil {
+		log.Printf("[DEBUG] Event %s delivered to %s\n", entry.EventId, entry.Relay)
+		a.dbUpdateOutboxEntry(entry, outboxSent, "", time.Time{})
+		return nil
+	}
+
+	log.Println("[ERROR]", err)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// shutting down, the retrier picks the entry up after the restart
+		return err
+	}
+	attempts := entry.Attempts + 1
+	if time.Since(entry.CreatedAt) > outboxGiveUp {
+		log.Printf("[WARN] Giving up on event %s for %s after %d attempts\n", entry.EventId, entry.Relay, attempts)
+		a.dbUpdateOutboxEntry(entry, outboxFailed, err.Error(), time.Time{})
+		return err
+	}
+	backoff := outboxBackoffMin << (attempts - 1)
+	if backoff > outboxBackoffMax || backoff <= 0 {
+		backoff = outboxBackoffMax
+	}
+	a.dbUpdateOutboxEntry(entry, outboxPending, err.Error(), time.Now().Add(backoff))
+	return err
+}
+
+// outboxRetrier periodically resends pending outbox entries and publishes
+// deferred posts that are due.
+func (a *Atomstr) outboxRetrier(ctx context.Context) {
+	ticker := time.NewTicker(outboxRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.retryOutbox(ctx)
+			a.retryDeferredPosts(ctx)
+		}
+	}
+}
+
+func (a *Atomstr) retryOutbox(ctx context.Context) {
+	entries := a.dbGetDueOutboxEntries()
+	if len(entries) == 0 {
+		return
+	}
+	log.Printf("[INFO] Retrying %d outbox deliveries\n", len(entries))
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		entryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		a.deliverOutboxEntry(entryCtx, entry)
+		cancel()
+	}
+}
+
+func (a *Atomstr) dbEnqueueOutbox(ev nostr.Event, feedUrl string, relays []string) bool {
+	evJSON, err := json.Marshal(ev)
+	if err != nil {
+		log.Println("[ERROR] Failed to encode event for outbox:", err)
+		return false
+	}
+	now := time.Now()
+	// the first delivery is done by the caller, keep the retrier away until then
+	nextAttempt := now.Add(outboxBackoffMin)
+	// all relays or none, the caller falls back to publishing directly
+	tx, err := a.db.Begin()
+	if err != nil {
+		log.Println("[ERROR] Failed to enqueue outbox entry:", err)
+		return false
+	}
+	defer tx.Rollback()
+	sqlStatement := `INSERT OR IGNORE INTO outbox (event_id, relay, event, feed_url, state, attempts, created_at, next_attempt_at) VALUES (?, ?, ?, ?, ?, 0, ?, ?);`
+	for _, relay := range relays {
+		_, err := tx.Exec(sqlStatement, ev.ID, nostr.NormalizeURL(relay), string(evJSON), feedUrl, outboxPending, now.Unix(), nextAttempt.Unix())
+		if err != nil {
+			log.Println("[ERROR] Failed to enqueue outbox entry:", err)
+			return false
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("[ERROR] Failed to enqueue outbox entry:", err)
+		return false
+	}
+	return true
+}
+
+func (a *Atomstr) dbUpdateOutboxEntry(entry outboxEntry, state, lastError string, nextAttempt time.Time) {
+	sqlStatement := `UPDATE outbox SET state=?, attempts=attempts+1, last_error=?, next_attempt_at=? WHERE event_id=? AND relay=?;`
+	_, err := a.db.Exec(sqlStatement, state, lastError, nextAttempt.Unix(), entry.EventId, entry.Relay)
+	if err != nil {
+		log.Println("[ERROR] Failed to update outbox entry:", err)
+	}
+}
+
+func (a *Atomstr) dbGetOutboxEntries(eventId string) []outboxEntry {
+	sqlStatement := `SELECT event_id, relay, event, feed_url, attempts, created_at FROM outbox WHERE event_id=? AND state=?;`
+	return a.dbQueryOutbox(sqlStatement, eventId, outboxPending)
+}
+
+func (a *Atomstr) dbGetDueOutboxEntries() []outboxEntry {
+	sqlStatement := `SELECT event_id, relay, event, feed_url, attempts, created_at FROM outbox WHERE state=? AND next_attempt_at<=? ORDER BY next_attempt_at;`
+	return a.dbQueryOutbox(sqlStatement, outboxPending, time.Now().Unix())
+}
+
+func (a *Atomstr) dbQueryOutbox(sqlStatement string, args ...any) []outboxEntry {
+	rows, err := a.db.Query(sqlStatement, args...)
+	if err != nil {
+		log.Println("[ERROR] Failed to read outbox:", err)
+		return nil
+	}
+	defer rows.Close()
+
+	entries := []outboxEntry{}
+	for rows.Next() {
+		entry := outboxEntry{}
+		var evJSON string
+		var createdAt int64
+		if err := rows.Scan(&entry.EventId, &entry.Relay, &evJSON, &entry.FeedUrl, &entry.Attempts, &createdAt); err != nil {
+			log.Println("[ERROR] Scanning outbox failed:", err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(evJSON), &entry.Event); err != nil {
+			log.Println("[ERROR] Decoding outbox event failed:", err)
+			continue
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (a *Atomstr) dbPruneOutbox(olderThan time.Duration) (int64, error) {
+	cutoffTime := time.Now().Add(-olderThan).Unix()
+	sqlStatement := `DELETE FROM outbox WHERE state<>? AND created_at < ?;`
+	result, err := a.db.Exec(sqlStatement, outboxPending, cutoffTime)
+	if err != nil {
+		log.Println("[ERROR] Failed to prune outbox:", err)
+		return 0, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	log.Printf("[INFO] Pruned %d outbox entries older than %v", rowsAffected, olderThan)
+	return rowsAffected, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var relayBackoffMin = 10 * time.Second
+var relayBackoffMax = 10 * time.Minute
+
+// errRelayRejected wraps the reason of a relay that refused an event.
+var errRelayRejected = errors.New("rejected by relay")
+
+// relayStatus is a snapshot of the health of a single relay in the pool.
+type relayStatus struct {
+	Url           string    `json:"url"`
+	Connected     bool      `json:"connected"`
+	Failures      int       `json:"failures"`
+	LastError     string    `json:"last_error,omitempty"`
+	NextAttempt   time.Time `json:"next_attempt,omitempty"`
+	LastPublished time.Time `json:"last_published,omitempty"`
+}
+
+// poolRelay wraps a long-lived relay connection together with its health state.
+type poolRelay struct {
+	mu     sync.Mutex
+	url    string
+	relay  *nostr.Relay
+	status relayStatus
+}
+
+// relayPool keeps one shared connection per relay. Connections are opened on
+// first use and reopened when they drop. Relays that fail are put into an
+// exponential backoff during which publishes to them fail fast.
+type relayPool struct {
+	ctx    context.Context
+	mu     sync.Mutex
+	relays map[string]*poolRelay
+}
+
+func newRelayPool(ctx context.Context) *relayPool {
+	return &relayPool{
+		ctx:    ctx,
+		relays: map[string]*poolRelay{},
+	}
+}
+
+func (p *relayPool) get(url string) *poolRelay {
+	url = nostr.NormalizeURL(url)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.relays[url]
+	if !ok {
+		pr = &poolRelay{url: url, status: relayStatus{Url: url}}
+		p.relays[url] = pr
+	}
+	return pr
+}
+
+// connection returns a connected relay, reconnecting if needed.
+func (pr *poolRelay) connection(ctx, poolCtx context.Context) (*nostr.Relay, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.relay != nil && pr.relay.IsConnected() {
+		return pr.relay, nil
+	}
+	if time.Now().Before(pr.status.NextAttempt) {
+		return nil, errors.New("relay " + pr.url + " is backing off: " + pr.status.LastError)
+	}
+
+	relay := nostr.NewRelay(poolCtx, pr.url)
+	if err := relay.Connect(ctx); err != nil {
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			pr.failLocked(err)
+		}
+		return nil, err
+	}
+	log.Println("[DEBUG] Connected to relay", pr.url)
+	pr.relay = relay
+	pr.status.Connected = true
+	return relay, nil
+}
+
+func (pr *poolRelay) fail(err error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.failLocked(err)
+}
+
+func (pr *poolRelay) failLocked(err error) {
+	pr.status.Failures++
+	pr.status.LastError = err.Error()
+	backoff := relayBackoffMin << (pr.status.Failures - 1)
+	if backoff > relayBackoffMax || backoff <= 0 {
+		backoff = relayBackoffMax
+	}
+	pr.status.NextAttempt = time.Now().Add(backoff)
+	if pr.relay != nil && !pr.relay.IsConnected() {
+		pr.relay = nil
+	}
+	pr.status.Connected = pr.relay != nil
+}
+
+func (pr *poolRelay) succeed() {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.status.Failures = 0
+	pr.status.LastError = ""
+	pr.status.NextAttempt = time.Time{}
+	pr.status.LastPublished = time.Now()
+	pr.status.Connected = true
+}
+
+// publishTo sends an event to a single relay of the pool.
+func (p *relayPool) publishTo(ctx context.Context, url string, ev nostr.Event) error {
+	pr := p.get(url)
+	relay, err := pr.connection(ctx, p.ctx)
+	if err != nil {
+		return err
+	}
+	if err := relay.Publish(ctx, ev); err != nil {
+		if relayRejected(ctx, relay, err) {
+			// the relay works, it just doesn't take this event
+			return fmt.Errorf("%w: %v", errRelayRejected, err)
+		}
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			// a cancelled publish says nothing about the relay
+			pr.fail(err)
+		}
+		return err
+	}
+	pr.succeed()
+	return nil
+}
+
+// relayRejected reports whether a publish failed because the relay answered
+// OK false, e.g. for a duplicate or its policy, and not because of the
+// connection or a timeout.
+func relayRejected(ctx context.Context, relay *nostr.Relay, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, context.DeadlineExceeded) && relay.IsConnected()
+}
+
+// publish sends an event to all given relays concurrently and returns the
+// number of relays that accepted and rejected it.
+func (p *relayPool) publish(ctx context.Context, urls []string, ev nostr.Event) (int, int) {
+	var mu sync.Mutex
+	wg := sync.WaitGroup{}
+	successCount := 0
+	errCount := 0
+
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			err := p.publishTo(ctx, url, ev)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Println("[ERROR]", err)
+				errCount++
+				return
+			}
+			log.Printf("[DEBUG] Event published to %s\n", url)
+			successCount++
+		}(url)
+	}
+	wg.Wait()
+	return successCount, errCount
+}
+
+// status returns the health of all relays the pool has seen so far.
+func (p *relayPool) status() []relayStatus {
+	p.mu.Lock()
+	relays := make([]*poolRelay, 0, len(p.relays))
+	for _, pr := range p.relays {
+		relays = append(relays, pr)
+	}
+	p.mu.Unlock()
+
+	statuses := make([]relayStatus, 0, len(relays))
+	for _, pr := range relays {
+		pr.mu.Lock()
+		st := pr.status
+		st.Connected = pr.relay != nil && pr.relay.IsConnected()
+		pr.mu.Unlock()
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Url < statuses[j].Url })
+	return statuses
+}
+
+// close disconnects all relays of the pool.
+func (p *relayPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pr := range p.relays {
+		pr.mu.Lock()
+		if pr.relay != nil {
+			pr.relay.Close()
+			pr.relay = nil
+		}
+		pr.status.Connected = false
+		pr.mu.Unlock()
+	}
+}
+
+// relayHealth returns the status of the default publish relays, including
+// those that have not been used yet, followed by any per-feed relays.
+func (a *Atomstr) relayHealth() []relayStatus {
+	pool := a.relays.status()
+	known := map[string]relayStatus{}
+	for _, st := range pool {
+		known[st.Url] = st
+	}
+	statuses := []relayStatus{}
+	for _, url := range relaysToPublishTo {
+		url = nostr.NormalizeURL(url)
+		if st, ok := known[url]; ok {
+			statuses = append(statuses, st)
+			delete(known, url)
+		} else {
+			statuses = append(statuses, relayStatus{Url: url})
+		}
+	}
+	for _, st := range pool {
+		if _, ok := known[st.Url]; ok {
+			statuses = append(statuses, st)
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Run outcomes
+const (
+	runRunning     = "running"
+	runDone        = "done"
+	runInterrupted = "interrupted"
+)
+
+// runStruct is one scrape or metadata run over all feeds.
+type runStruct struct {
+	Id         int64  `json:"id"`
+	Work       string `json:"work"`
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+	Outcome    string `json:"outcome"`
+	Feeds      int    `json:"feeds"`   // feeds processed
+	Failed     int    `json:"failed"`  // feeds that could not be processed
+	Skipped    int    `json:"skipped"` // feeds busy in another run or job
+}
+
+// scheduler keeps track of running work. There is at most one run per work
+// type and every feed is handled by one run or job at a time.
+type scheduler struct {
+	mu      sync.Mutex
+	running map[string]*runStruct    // by work type
+	feeds   map[string]chan struct{} // busy feeds, closed when released
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		running: map[string]*runStruct{},
+		feeds:   map[string]chan struct{}{},
+	}
+}
+
+// begin registers a new run, unless one of the same work type is in progress.
+func (s *scheduler) begin(work string) (*runStruct, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, busy := s.running[work]; busy {
+		return nil, false
+	}
+	run := &runStruct{Work: work, StartedAt: time.Now().Unix(), Outcome: runRunning}
+	s.running[work] = run
+	return run, true
+}
+
+func (s *scheduler) setRunId(run *runStruct, id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run.Id = id
+}
+
+// count records the result of one feed of a run.
+func (s *scheduler) count(run *runStruct, skipped bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case skipped:
+		run.Skipped++
+	case err != nil:
+		run.Failed++
+	default:
+		run.Feeds++
+	}
+}
+
+func (s *scheduler) end(run *runStruct, outcome string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run.FinishedAt = time.Now().Unix()
+	run.Outcome = outcome
+	delete(s.running, run.Work)
+}
+
+// inProgress returns copies of the running runs.
+func (s *scheduler) inProgress() []runStruct {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := []runStruct{}
+	for _, run := range s.running {
+		runs = append(runs, *run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Work < runs[j].Work })
+	return runs
+}
+
+// tryLockFeed marks a feed as busy. It returns false if it already is.
+func (s *scheduler) tryLockFeed(feedUrl string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, busy := s.feeds[feedUrl]; busy {
+		return false
+	}
+	s.feeds[feedUrl] = make(chan struct{})
+	return true
+}
+
+// lockFeed waits until a feed is free and marks it as busy. It returns false
+// if ctx ends first.
+func (s *scheduler) lockFeed(ctx context.Context, feedUrl string) bool {
+	for {
+		s.mu.Lock()
+		released, busy := s.feeds[feedUrl]
+		if !busy {
+			s.feeds[feedUrl] = make(chan struct{})
+			s.mu.Unlock()
+			return true
+		}
+		s.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (s *scheduler) unlockFeed(feedUrl string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if released, busy := s.feeds[feedUrl]; busy {
+		close(released)
+		delete(s.feeds, feedUrl)
+	}
+}
+
+// startWorkers runs work over the given feeds with maxWorkers in parallel. It
+// does nothing if a run of the same work is still in progress. Scrapes are
+// run by scrapeLoop.
+func (a *Atomstr) startWorkers(ctx context.Context, work string, feeds []feedStruct) {
+	var process func(context.Context, feedStruct) error
+	switch work {
+	case "metadata":
+		process = a.processFeedMetadata
+	default:
+		log.Println("[ERROR] Invalid work type", work)
+		return
+	}
+
+	run, ok := a.sched.begin(work)
+	if !ok {
+		log.Println("[WARN] Previous", work, "run still in progress, skipping")
+		return
+	}
+	a.sched.setRunId(run, a.dbStartRun(run))
+
+	if len(feeds) == 0 {
+		log.Println("[WARN] No feeds found")
+	}
+
+	log.Println("[INFO] Start", work)
+
+	ch := make(chan feedStruct)
+	wg := sync.WaitGroup{}
+
+	// start the workers
+	for t := 0; t < maxWorkers; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for feedItem := range ch {
+				if !a.sched.tryLockFeed(feedItem.Url) {
+					log.Println("[DEBUG] Feed busy, skipping", feedItem.Url)
+					a.sched.count(run, true, nil)
+					continue
+				}
+				err := process(ctx, feedItem)
+				a.sched.unlockFeed(feedItem.Url)
+				a.sched.count(run, false, err)
+			}
+		}()
+	}
+
+	// push the lines to the queue channel for processing
+feedLoop:
+	for _, feedItem := range feeds {
+		select {
+		case ch <- feedItem:
+		case <-ctx.Done():
+			log.Println("[INFO] Interrupted", work)
+			break feedLoop
+		}
+	}
+
+	close(ch) // this will cause the workers to stop and exit their receive loop
+	wg.Wait() // make sure they all exit
+
+	outcome := runDone
+	if ctx.Err() != nil {
+		outcome = runInterrupted
+	}
+	a.sched.end(run, outcome)
+	a.dbFinishRun(run)
+	log.Printf("[INFO] Stop %s: %d feeds, %d failed, %d skipped\n", work, run.Feeds, run.Failed, run.Skipped)
+}
+
+// schedule starts the metadata runs, right away and then every
+// metadataInterval, and the scrape loop that fetches every feed when it is
+// due. A metadata run that is due while the previous one is still going is
+// skipped.
+func (a *Atomstr) schedule(ctx context.Context) {
+	// first run
+	a.startWorkers(ctx, "metadata", *a.dbGetActiveFeeds())
+	a.spawn(func() { a.scrapeLoop(ctx) })
+
+	metadataTicker := time.NewTicker(metadataInterval)
+	defer metadataTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-metadataTicker.C:
+			a.spawn(func() { a.startWorkers(ctx, "metadata", *a.dbGetActiveFeeds()) })
+		}
+	}
+}
+
+func (a *Atomstr) dbStartRun(run *runStruct) int64 {
+	sqlStatement := `INSERT INTO runs (work, started_at, outcome) VALUES (?, ?, ?);`
+	res, err := a.db.Exec(sqlStatement, run.Work, run.StartedAt, run.Outcome)
+	if err != nil {
+		log.Println("[ERROR] Failed to record run:", err)
+		return 0
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+func (a *Atomstr) dbFinishRun(run *runStruct) {
+	sqlStatement := `UPDATE runs SET finished_at=?, outcome=?, feeds=?, failed=?, skipped=? WHERE id=?;`
+	_, err := a.db.Exec(sqlStatement, run.FinishedAt, run.Outcome, run.Feeds, run.Failed, run.Skipped, run.Id)
+	if err != nil {
+		log.Println("[ERROR] Failed to record run:", err)
+	}
+}
+
+// dbInterruptRuns marks runs left over from a crash as interrupted.
+func (a *Atomstr) dbInterruptRuns() {
+	_, err := a.db.Exec(`UPDATE runs SET outcome=? WHERE outcome=?;`, runInterrupted, runRunning)
+	if err != nil {
+		log.Println("[ERROR] Failed to update runs:", err)
+	}
+}
+
+// dbGetRuns returns the latest runs, newest first.
+func (a *Atomstr) dbGetRuns(limit int) ([]runStruct, error) {
+	sqlStatement := `SELECT id, work, started_at, finished_at, outcome, feeds, failed, skipped FROM runs ORDER BY id DESC LIMIT ?;`
+	rows, err := a.db.Query(sqlStatement, limit)
+	if err != nil {
+		log.Println("[ERROR] Failed to read runs:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []runStruct{}
+	for rows.Next() {
+		run := runStruct{}
+		if err := rows.Scan(&run.Id, &run.Work, &run.StartedAt, &run.FinishedAt, &run.Outcome, &run.Feeds, &run.Failed, &run.Skipped); err != nil {
+			log.Println("[ERROR] Scanning runs failed:", err)
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// runStatus returns the current run of every work type, or the last one if
+// none is in progress.
+func (a *Atomstr) runStatus() []runStruct {
+	runs := a.sched.inProgress()
+	seen := map[string]bool{}
+	for _, run := range runs {
+		seen[run.Work] = true
+	}
+	recent, _ := a.dbGetRuns(10)
+	for _, run := range recent {
+		if !seen[run.Work] {
+			seen[run.Work] = true
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Work < runs[j].Work })
+	return runs
+}
+
+// dbPruneRuns removes finished runs older than the given duration.
+func (a *Atomstr) dbPruneRuns(olderThan time.Duration) (int64, error) {
+	cutoffTime := time.Now().Add(-olderThan).Unix()
+	sqlStatement := `DELETE FROM runs WHERE outcome<>? AND started_at < ?;`
+	result, err := a.db.Exec(sqlStatement, runRunning, cutoffTime)
+	if err != nil {
+		log.Println("[ERROR] Failed to prune runs:", err)
+		return 0, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	log.Printf("[INFO] Pruned %d runs older than %v", rowsAffected, olderThan)
+	return rowsAffected, nil
+}
@@ -1,37 +1,136 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr/nip05"
 	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"unixtime": func(t int64) string {
+		return time.Unix(t, 0).UTC().Format("2006-01-02 15:04 UTC")
+	},
+}
+
+// appContextKey holds the root context in the base context of requests.
+type appContextKey struct{}
+
+// appContext returns the root context a request was served with. Unlike
+// r.Context() it is not cancelled when the client goes away, only when
+// atomstr shuts down.
+func appContext(r *http.Request) context.Context {
+	if ctx, ok := r.Context().Value(appContextKey{}).(context.Context); ok {
+		return ctx
+	}
+	return context.WithoutCancel(r.Context())
+}
+
 func (a *Atomstr) webMain(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("templates/index.tmpl"))
+	tmpl := template.Must(template.New("index.tmpl").Funcs(templateFuncs).ParseFiles("templates/index.tmpl"))
 	feeds := a.dbGetAllFeeds()
 	data := webIndex{
-		Relays:  relaysToPublishTo,
-		Feeds:   *feeds,
-		Version: atomstrversion,
+		Relays:          a.relayHealth(),
+		DefaultRelays:   relaysToPublishTo,
+		Modes:           feedModes,
+		Dedupes:         dedupeStrategies,
+		DefaultInterval: fetchInterval.String(),
+		Feeds:           *feeds,
+		Runs:            a.runStatus(),
+		Version:         atomstrversion,
 	}
 	tmpl.Execute(w, data)
 }
 
 func (a *Atomstr) webAdd(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(template.ParseFiles("templates/add.tmpl"))
-	feedItem, err := a.addSource(r.FormValue("url"))
+	feedItem := &feedStruct{}
+	var job *jobStruct
+	settings, err := webFeedSettings(r)
+	if err == nil {
+		feedItem, job, err = a.addSourceAsync(appContext(r), r.FormValue("url"), settings)
+	}
+
+	data := webAddFeed{Feed: *feedItem, Job: job}
+	var candidates *feedCandidatesError
+	if errors.As(err, &candidates) {
+		data.Status = "This site offers several feeds, pick one."
+		data.Candidates = candidates.Candidates
+		data.Form = map[string]string{}
+		for _, key := range []string{"relays", "tags", "mode", "dedupe", "interval"} {
+			if _, ok := r.Form[key]; ok {
+				data.Form[key] = r.FormValue(key)
+			}
+		}
+	} else if err != nil {
+		data.Status = "No feed found or feed already exists."
+	} else {
+		data.Feed.Npub, _ = nip19.EncodePublicKey(feedItem.Pub)
+		data.Status = "Success! Check your feed below and open it with your preferred app."
+		if job == nil {
+			data.Status = "Feed added, its posts will be published with the next update."
+		}
+	}
+
+	tmpl.Execute(w, data)
+}
+
+// webFeedSettings reads the feed settings present in a submitted form.
+func webFeedSettings(r *http.Request) (feedSettings, error) {
+	r.ParseForm()
+	var relays, tags, mode, dedupe, interval *string
+	if _, ok := r.Form["relays"]; ok {
+		v := r.FormValue("relays")
+		relays = &v
+	}
+	if _, ok := r.Form["tags"]; ok {
+		v := r.FormValue("tags")
+		tags = &v
+	}
+	if _, ok := r.Form["mode"]; ok {
+		v := r.FormValue("mode")
+		mode = &v
+	}
+	if _, ok := r.Form["dedupe"]; ok {
+		v := r.FormValue("dedupe")
+		dedupe = &v
+	}
+	if _, ok := r.Form["interval"]; ok {
+		v := r.FormValue("interval")
+		interval = &v
+	}
+	return parseFeedSettings(relays, tags, mode, dedupe, interval)
+}
+
+func (a *Atomstr) webSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("templates/add.tmpl"))
+	feedItem := &feedStruct{}
+	settings, err := webFeedSettings(r)
+	if err == nil {
+		feedItem, err = a.updateFeedSettings(r.Context(), r.FormValue("url"), settings)
+	}
 
 	var status string
 	if err != nil {
-		status = "No feed found or feed already exists."
+		status = "Could not update feed: " + err.Error()
 	} else {
 		feedItem.Npub, _ = nip19.EncodePublicKey(feedItem.Pub)
-		status = "Success! Check your feed below and open it with your preferred app."
+		status = "Feed settings updated."
 	}
 	data := webAddFeed{
 		Status: status,
@@ -41,6 +140,86 @@ func (a *Atomstr) webAdd(w http.ResponseWriter, r *http.Request) {
 	tmpl.Execute(w, data)
 }
 
+// webImport queues a job for every feed of an uploaded OPML file and lists
+// the jobs as plain text.
+func (a *Atomstr) webImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("opml")
+	if err != nil {
+		http.Error(w, "no OPML file uploaded", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	settings, err := webFeedSettings(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	jobs, skipped, err := a.queueOPMLImport(file, settings)
+	if err != nil && len(jobs) == 0 {
+		http.Error(w, "Import failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s queued as job %s, see /jobs/%s\n", job.FeedUrl, job.Id, job.Id)
+	}
+	if err != nil {
+		fmt.Fprintln(w, "Import stopped:", err)
+	}
+	fmt.Fprintf(w, "\n%d feeds queued, %d skipped as they already exist\n", len(jobs), skipped)
+}
+
+func (a *Atomstr) webExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="atomstr.opml"`)
+	if err := a.exportOPML(w); err != nil {
+		log.Println("[ERROR] OPML export failed:", err)
+	}
+}
+
+// webPause and webResume change the state of a feed and go back to the index.
+func (a *Atomstr) webPause(w http.ResponseWriter, r *http.Request) {
+	if _, err := a.pauseFeed(r.FormValue("url")); errors.Is(err, errFeedNotFound) {
+		http.Error(w, "Could not pause feed: "+err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Could not pause feed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (a *Atomstr) webResume(w http.ResponseWriter, r *http.Request) {
+	if _, err := a.resumeFeed(r.FormValue("url")); errors.Is(err, errFeedNotFound) {
+		http.Error(w, "Could not resume feed: "+err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Could not resume feed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (a *Atomstr) webJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.dbGetJob(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("templates/job.tmpl"))
+	tmpl.Execute(w, job)
+}
+
 func (a *Atomstr) webNip05(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("name")
 	name, _ = url.QueryUnescape(name)
@@ -56,7 +235,7 @@ func (a *Atomstr) webNip05(w http.ResponseWriter, r *http.Request) {
 				name: feedItem.Pub,
 			},
 			Relays: map[string][]string{
-				feedItem.Pub: relaysToPublishTo,
+				feedItem.Pub: feedItem.publishRelays(),
 			},
 		}
 		response, _ = json.Marshal(nip05WellKnownResponse)
@@ -64,11 +243,38 @@ func (a *Atomstr) webNip05(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (a *Atomstr) webserver() {
+// webserver starts serving in the background. Requests inherit ctx, so they
+// see the shutdown; the caller stops the returned server.
+func (a *Atomstr) webserver(ctx context.Context) *http.Server {
 	http.HandleFunc("/", a.webMain)
-	http.HandleFunc("/add", a.webAdd)
+	http.HandleFunc("/add", a.requireAdmin(a.webAdd))
+	http.HandleFunc("/settings", a.requireAdmin(a.webSettings))
+	http.HandleFunc("/relays", a.requireAdmin(a.webSettings)) // old name of /settings
+	http.HandleFunc("/import", a.requireAdmin(a.webImport))
+	http.HandleFunc("POST /pause", a.requireAdmin(a.webPause))
+	http.HandleFunc("POST /resume", a.requireAdmin(a.webResume))
+	http.HandleFunc("/export.opml", a.webExport)
+	http.HandleFunc("GET /jobs/{id}", a.webJob)
 	http.HandleFunc("/.well-known/nostr.json", a.webNip05)
+	a.apiRoutes(http.DefaultServeMux)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	if err := checkAuthConfig(); err != nil {
+		log.Fatal("[ERROR] ", err)
+	}
+	if !authEnabled() && adminAuthDisabled {
+		log.Println("[WARN] ADMIN_AUTH_DISABLED is set, anyone can add and change feeds")
+	} else if !authEnabled() {
+		log.Println("[WARN] No ADMIN_TOKEN, ADMIN_USER or ADMIN_NPUBS set, adding and changing feeds over HTTP is disabled")
+	}
 	log.Println("[INFO] Starting webserver at port", webserverPort)
-	log.Fatal(http.ListenAndServe(":"+webserverPort, nil))
+	srv := &http.Server{
+		Addr:        ":" + webserverPort,
+		BaseContext: func(net.Listener) context.Context { return context.WithValue(ctx, appContextKey{}, ctx) },
+	}
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	return srv
 }
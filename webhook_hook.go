@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// WebhookHook POSTs every published post as JSON to a URL. With a secret the
+// body is signed with HMAC-SHA256 in the X-Atomstr-Signature header. Retries
+// are done by the hook policy.
+type WebhookHook struct {
+	url     string
+	headers map[string]string
+	secret  string
+	client  *http.Client
+}
+
+func NewWebhookHook(rawURL string, headers map[string]string, secret string) *WebhookHook {
+	return &WebhookHook{
+		url:     rawURL,
+		headers: headers,
+		secret:  secret,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type webhookRequest struct {
+	Feed       feedStruct     `json:"feed"`
+	FeedPost   feedPostStruct `json:"feedPost"`
+	NostrEvent nostr.Event    `json:"nostrEvent"`
+	Relays     []relayResult  `json:"relays"`
+}
+
+func (h *WebhookHook) AfterPublish(ctx context.Context, feed feedStruct, feedPost feedPostStruct, event nostr.Event, results []relayResult) error {
+	body, err := json.Marshal(webhookRequest{Feed: feed, FeedPost: feedPost, NostrEvent: event, Relays: results})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if h.secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write(body)
+		req.Header.Set("X-Atomstr-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	for k, v := range h.headers {
+		if strings.HasPrefix(v, "$") {
+			v = os.Getenv(v[1:])
+			if v == "" {
+				return errors.New("header specifed an env, but env variable not found: " + k)
+			}
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}